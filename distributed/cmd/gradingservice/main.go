@@ -6,16 +6,27 @@ import (
 	"distributed/log"
 	"distributed/registry"
 	"distributed/service"
+	"flag"
 	"fmt"
 	stlog "log"
+	"time"
 )
 
 // 业务服务的启动程序
 
 func main(){
-	host, port := "localhost", "6000"
+	// 注册中心地址：-registry 参数 > REGISTRY_URL 环境变量 > 默认地址
+	registryURL := registry.ServicesURLFlag()
+	// 监听端口：同时运行多个副本时为每个副本指定不同的端口
+	listenPort := flag.String("port", "6000", "port the grading service listens on")
+	weight := flag.Int("weight", 1, "weight of this instance for weighted load balancing")
+	wait := flag.Duration("wait", 30*time.Second, "how long to wait for required services on startup")
+	spool := flag.String("log-spool", "", "file to keep logs in while the log service is unreachable (empty keeps them in memory only)")
+	flag.Parse()
+
+	host, port := "localhost", *listenPort
 	serviceAddress := fmt.Sprintf("http://%v:%v", host, port)
-	//(ctx context.Context, host, port string, reg registry.Registration,registerHandlersFunc func())
+	//(ctx context.Context, host, port string, reg registry.Registration,registerHandlersFunc func(mux *http.ServeMux))
 
 	reg := registry.Registration {
 		ServiceName: registry.GradingService,
@@ -23,19 +34,31 @@ func main(){
 		RequiredServices: []registry.ServiceName{registry.LogService},
 		ServiceUpdateURL: serviceAddress + "/services",
 		HeartbeatURL:     serviceAddress + "/heartbeat",
+		Weight:           *weight,
 	}
 
-	ctx, err := service.Start(context.Background(),host,port,reg,grades.RegisterHandlers)
+	// 等待依赖的服务可用后再开始接收请求；LogService 不可用时日志先写到标准错误，不等待它
+	waitCtx, cancel := context.WithTimeout(context.Background(), *wait)
+	defer cancel()
+	ctx, err := service.Start(context.Background(),*registryURL,host,port,reg,grades.RegisterHandlers,
+		service.WithHealthCheck("data store loaded", grades.CheckDataStore),
+		service.WaitForDependencies(waitCtx),
+		service.WithOptionalDependencies(registry.LogService),
+	)
 	if err != nil{
 		stlog.Fatal(err)
 	}
 
-	if logProvider, err := registry.GetProvider(registry.LogService); err == nil {
-		fmt.Printf("Logging service found at %s\n", logProvider)
-		log.SetClientLogger(logProvider, reg.ServiceName)
-	}
+	// 日志发送到 LogService，每次发送时通过注册中心解析实例
+	log.SetClientLogger(reg.ServiceName, serviceAddress, log.ShipperConfig{SpoolFile: *spool})
 	
 	// 接收服务关闭信号
 	<-ctx.Done()
+	// 退出前把还没有发送的日志发出去
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if err := log.Flush(flushCtx); err != nil {
+		fmt.Println("Failed to flush logs:", err)
+	}
 	fmt.Println("Shutting down grading service")
 }
\ No newline at end of file
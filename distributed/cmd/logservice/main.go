@@ -7,13 +7,43 @@ import (
 	"distributed/log"
 	"distributed/registry"
 	"distributed/service"
+	"flag"
 	"fmt"
 	stlog "log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main(){
-	// 创建新的日志记录器、指定输出位置
-	log.Run("./distributed.log")
+	// 注册中心地址：-registry 参数 > REGISTRY_URL 环境变量 > 默认地址
+	registryURL := registry.ServicesURLFlag()
+	var policy log.RotationPolicy
+	flag.Int64Var(&policy.MaxSize, "max-size", 100<<20, "rotate the log file when it exceeds this many bytes (0 disables)")
+	flag.BoolVar(&policy.Daily, "daily", true, "rotate the log file every day")
+	flag.BoolVar(&policy.Compress, "compress", true, "gzip rotated log files")
+	flag.DurationVar(&policy.MaxAge, "max-age", 7*24*time.Hour, "delete rotated log files older than this (0 keeps them)")
+	flag.Int64Var(&policy.MaxTotalSize, "max-total-size", 1<<30, "delete the oldest rotated log files when they exceed this many bytes in total (0 disables)")
+	flag.Parse()
+
+	// 打开日志文件、指定切割策略
+	err := log.Run("./distributed.log", policy)
+	if err != nil {
+		stlog.Fatalln(err)
+	}
+	defer log.Close()
+	// 收到 SIGHUP 时重新打开日志文件，配合外部的 logrotate 等工具
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := log.Reopen(); err != nil {
+				stlog.Println(err)
+			}
+		}
+	}()
 	// 指定 服务名称，服务监听ip端口，日志服务处理程序
 	host, port := "localhost","4000"
 	serviceAddress := fmt.Sprintf("http://%s:%s", host, port)
@@ -26,12 +56,16 @@ func main(){
 		HeartbeatURL:     serviceAddress + "/heartbeat",
 	}
 
+	// 收到 SIGINT/SIGTERM 时取消 sigCtx：开始关闭服务，同时结束正在推送的 /log/tail
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	ctx, err := service.Start(
-		context.Background(),
+		sigCtx,
+		*registryURL,
 		host,
 		port,
 		r,
-		log.RegisterHandlers,
+		func(mux *http.ServeMux) { log.RegisterHandlers(mux, sigCtx.Done()) },
 	)
 
 	// 如果日志服务启动失败，记录失败原因
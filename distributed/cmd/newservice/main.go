@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
+	"distributed/log"
 	"distributed/registry"
 	"distributed/service"
+	"flag"
 	"fmt"
 	stlog "log"
 	"distributed/new"
 )
 
 func main() {
+	// 注册中心地址：-registry 参数 > REGISTRY_URL 环境变量 > 默认地址
+	registryURL := registry.ServicesURLFlag()
+	flag.Parse()
+
 	host := "localhost"
 	port := "7000"
 	serviceAddress := fmt.Sprintf("http://%s:%s", host, port)
@@ -24,10 +30,12 @@ func main() {
 
 	ctx, err := service.Start(
 		context.Background(),
+		*registryURL,
 		host,
 		port,
 		reg,
 		new.RegisterHandlers,
+		service.WithHealthCheck("log provider known", log.CheckProviderKnown),
 	)
 
 	if err != nil {
@@ -5,10 +5,18 @@ import (
 	"distributed/portal"
 	"distributed/registry"
 	"distributed/service"
+	"flag"
 	"fmt"
 	stlog "log"
+	"time"
 )
 func main() {
+	// 注册中心地址：-registry 参数 > REGISTRY_URL 环境变量 > 默认地址
+	registryURL := registry.ServicesURLFlag()
+	wait := flag.Duration("wait", 30*time.Second, "how long to wait for required services on startup")
+	spool := flag.String("log-spool", "", "file to keep logs in while the log service is unreachable (empty keeps them in memory only)")
+	flag.Parse()
+
 	err := portal.ImportTemplates()
 	if err != nil {
 		stlog.Fatal(err)
@@ -25,17 +33,31 @@ func main() {
 		ServiceUpdateURL: serviceAddress + "/services",
 		HeartbeatURL:     serviceAddress + "/heartbeat",
 	}
+	// 同一个学生的请求固定到同一个 GradingService 实例
+	registry.SetBalancer(registry.GradingService, registry.NewConsistentHash(0))
+
+	// 等待 GradingService 可用后再开始接收请求；LogService 不可用时日志先写到标准错误，不等待它
+	waitCtx, cancel := context.WithTimeout(context.Background(), *wait)
+	defer cancel()
 	ctx, err := service.Start(context.Background(),
+		*registryURL,
 		host,
 		port,
 		r,
-		portal.RegisterHandlers)
+		portal.RegisterHandlers,
+		service.WaitForDependencies(waitCtx),
+		service.WithOptionalDependencies(registry.LogService))
 	if err != nil {
 		stlog.Fatal(err)
 	}
-	if logProvider, err := registry.GetProvider(registry.LogService); err == nil {
-		log.SetClientLogger(logProvider, r.ServiceName)
-	}
+	// 日志发送到 LogService，每次发送时通过注册中心解析实例
+	log.SetClientLogger(r.ServiceName, serviceAddress, log.ShipperConfig{SpoolFile: *spool})
 	<-ctx.Done()
+	// 退出前把还没有发送的日志发出去
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if err := log.Flush(flushCtx); err != nil {
+		fmt.Println("Failed to flush logs:", err)
+	}
 	fmt.Println("Shutting down portal")
 }
\ No newline at end of file
@@ -3,48 +3,129 @@ package main
 import (
 	"context"
 	"distributed/registry"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // 注册服务的可运行程序
 
 
 func main(){
+	// 监听地址：-addr 参数 > REGISTRY_ADDR 环境变量 > 默认端口
+	addr := flag.String("addr", registry.ServerAddrFromEnv(), "listen address of the registry service (env "+registry.ServerAddrEnv+")")
+	file := flag.String("file", registry.DefaultRegistryFile, "snapshot file used to persist registrations, the event log is kept next to it with a .wal suffix; in cluster mode defaults to a file named after -self")
+	// 集群模式：-self 为本节点的访问地址，-peers 为其他节点的地址（逗号分隔），不设置 -peers 时单机运行
+	self := flag.String("self", "", "URL of this node in a registry cluster, e.g. http://localhost:3001")
+	peers := flag.String("peers", "", "comma-separated URLs of the other nodes in the registry cluster")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for in-flight requests on shutdown")
+	flag.Parse()
+
+	var rs *registry.RegistryService
+	var err error
+	if *peers == "" {
+		rs = registry.NewRegistryService(*file)
+	} else {
+		if *self == "" {
+			log.Fatal("-self is required when -peers is set")
+		}
+		// 每个节点的 Raft 任期、投票和日志必须写到各自的文件：没有指定 -file 时按 -self 生成
+		if !flagSet("file") {
+			*file, err = nodeFile(*self)
+			if err != nil {
+				log.Fatalf("Invalid -self: %v", err)
+			}
+		}
+		rs = registry.NewClusterRegistryService(registry.NewFileStorage(*file), *self, strings.Split(*peers, ","))
+	}
 
 	// 加载之前保存的注册信息
-    err := registry.LoadFromFile()
+    err = rs.LoadFromFile()
     if err != nil {
         log.Fatalf("Failed to load registry from file: %v", err)
     }
 
 	// 相当于在这里开启一个go协程，不阻塞主线程
-	registry.SetupRegistryService()
+	rs.Setup()
 
-	http.Handle("/services", &registry.RegistryService{})
+	mux := http.NewServeMux()
+	rs.RegisterHandlers(mux)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	var server http.Server
-	server.Addr = registry.ServerPort
+	server.Addr = *addr
+	server.Handler = mux
+	// 关闭时取消所有请求的上下文，正在等待的长轮询请求立即返回
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	server.BaseContext = func(net.Listener) context.Context { return baseCtx }
+	server.RegisterOnShutdown(cancelRequests)
 
 	// 服务出现错误，打印到log，然后取消
 	go func() {
-		log.Println(server.ListenAndServe())
-		cancel()
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Println(err)
+			cancel()
+		}
 	}()
 
-	// 手动取消服务
+	// 收到 SIGINT/SIGTERM 时优雅关闭：在超时时间内等待正在处理的请求（包括长轮询）完成
 	go func() {
-		fmt.Println("Registry service started. Press any key to stop")
-		var s string
-		fmt.Scanln(&s)
-		server.Shutdown(ctx)
+		fmt.Printf("Registry service started on %s. Press Ctrl+C to stop\n", *addr)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		signal.Stop(signals)
+		log.Printf("Received %v, shutting down", sig)
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancelShutdown()
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Println(err)
+		}
+		rs.Stop()
 		cancel()
 	}()
 
 	<- ctx.Done()
 	fmt.Println("Shutting down registry service")
-}
\ No newline at end of file
+}
+
+// 命令行中是否显式设置了参数 name
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// 集群节点默认的持久化文件：按节点地址区分，例如 http://localhost:3001 对应 ./registry-localhost-3001.json，
+// 同一目录下启动的多个节点不会写同一组文件
+func nodeFile(self string) (string, error) {
+	u, err := url.Parse(self)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("%q has no host", self)
+	}
+	name := "registry-" + u.Hostname()
+	if port := u.Port(); port != "" {
+		name += "-" + port
+	}
+	return "./" + name + ".json", nil
+}
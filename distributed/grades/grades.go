@@ -3,6 +3,7 @@ package grades
 // 业务服务：关于学生的成绩管理（相当于一个model、dao）
 
 import (
+	"distributed/registry"
 	"fmt"
 	"sync"
 )
@@ -46,6 +47,17 @@ var (
 	studentsMutex sync.Mutex
 )
 
+// 健康检查：学生数据是否已经加载
+func CheckDataStore() (registry.HealthStatus, string) {
+	studentsMutex.Lock()
+	defer studentsMutex.Unlock()
+
+	if len(students) == 0 {
+		return registry.HealthCritical, "no students loaded"
+	}
+	return registry.HealthPassing, fmt.Sprintf("%d students loaded", len(students))
+}
+
 // 根据学生id查询学生
 func (ss Students) GetByID(id int) (*Student, error) {
 	for i := range ss {
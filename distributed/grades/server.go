@@ -10,13 +10,13 @@ import (
 	"strings"
 )
 
-// ctx context.Context, host, port string, reg registry.Registration,registerHandlersFunc func()
+// ctx context.Context, host, port string, reg registry.Registration,registerHandlersFunc func(mux *http.ServeMux)
 
 // 提供api
-func RegisterHandlers() {
+func RegisterHandlers(mux *http.ServeMux) {
 	handler := new(studentsHandler)
-	http.Handle("/students", handler)
-	http.Handle("/students/", handler)
+	mux.Handle("/students", handler)
+	mux.Handle("/students/", handler)
 }
 
 // 提供 处理http请求的 处理器以及处理方法
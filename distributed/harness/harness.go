@@ -0,0 +1,411 @@
+package harness
+
+// 进程内的多服务测试环境：在同一个进程中启动注册中心、LogService、GradingService 和 Portal，
+// 全部监听 127.0.0.1 上的随机端口。提供停止、模拟崩溃、重启实例的方法，
+// 以及记录服务收到的补丁，作为心跳、服务发现和 Portal 流程回归测试的基础。
+//
+//	c, err := harness.Start(harness.Config{GradingInstances: 2})
+//	if err != nil { ... }
+//	defer c.Close()
+//	c.Grading[0].Kill()
+//	_, err = c.WaitForPatch(registry.GradingService, 5*time.Second, harness.Removes(c.Grading[0].ID))
+
+import (
+	"context"
+	"distributed/grades"
+	"distributed/log"
+	"distributed/portal"
+	"distributed/registry"
+	"distributed/service"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 测试中使用的心跳策略：间隔较短，几百毫秒内就能发现实例故障
+var DefaultHeartbeat = registry.HeartbeatPolicy{
+	Interval:         200 * time.Millisecond,
+	Timeout:          200 * time.Millisecond,
+	FailureThreshold: 3,
+	SuccessThreshold: 1,
+}
+
+// 等待服务注册、恢复健康的默认时间
+const DefaultWaitTimeout = 10 * time.Second
+
+type Config struct {
+	GradingInstances int                      // GradingService 的实例数，默认 1
+	Heartbeat        registry.HeartbeatPolicy // 所有服务的心跳策略，默认 DefaultHeartbeat
+	DrainPeriod      time.Duration            // 停止实例时的 drain 时间，默认 0
+	Dir              string                   // LogService 写日志的目录，为空时使用临时目录
+	Rotation         log.RotationPolicy       // LogService 日志文件的切割策略，默认不切割
+}
+
+// 一组在同一进程中运行的服务
+type Cluster struct {
+	RegistryURL string           // 注册中心的 /services 地址
+	Registry    *httptest.Server // 注册中心
+	Log         *Instance
+	Grading     []*Instance
+	Portal      *Instance
+	LogFile     string // LogService 写入的日志文件
+
+	recorder *recorder
+	tempDir  string
+}
+
+// 启动注册中心和所有服务，并等待它们都注册为健康
+func Start(cfg Config) (*Cluster, error) {
+	if cfg.GradingInstances <= 0 {
+		cfg.GradingInstances = 1
+	}
+	if cfg.Heartbeat == (registry.HeartbeatPolicy{}) {
+		cfg.Heartbeat = DefaultHeartbeat
+	}
+
+	c := &Cluster{recorder: newRecorder()}
+	dir := cfg.Dir
+	if dir == "" {
+		var err error
+		dir, err = os.MkdirTemp("", "distributed-harness")
+		if err != nil {
+			return nil, err
+		}
+		c.tempDir = dir
+	}
+	c.LogFile = filepath.Join(dir, "distributed.log")
+
+	// 注册中心：使用内存存储，不写文件
+	rs := registry.NewRegistryServiceWithStorage(registry.NewMemoryStorage())
+	err := rs.LoadFromFile()
+	if err != nil {
+		return nil, err
+	}
+	rs.Setup()
+	mux := http.NewServeMux()
+	rs.RegisterHandlers(mux)
+	c.Registry = httptest.NewServer(mux)
+	c.RegistryURL = c.Registry.URL + "/services"
+
+	// 记录补丁
+	c.recorder.watch(registry.LogService)
+	c.recorder.watch(registry.GradingService)
+
+	err = portal.ImportTemplates()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	err = log.Run(c.LogFile, cfg.Rotation)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	c.Log, err = c.startInstance(cfg, registry.LogService, nil, log.RegisterHandlers)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	for i := 0; i < cfg.GradingInstances; i++ {
+		inst, err := c.startInstance(cfg, registry.GradingService, []registry.ServiceName{registry.LogService}, withoutDone(grades.RegisterHandlers),
+			service.WithHealthCheck("data store loaded", grades.CheckDataStore))
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.Grading = append(c.Grading, inst)
+	}
+	c.Portal, err = c.startInstance(cfg, registry.PortalService, []registry.ServiceName{registry.LogService, registry.GradingService}, withoutDone(portal.RegisterHandlers))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	for name, n := range map[registry.ServiceName]int{
+		registry.LogService:     1,
+		registry.GradingService: cfg.GradingInstances,
+		registry.PortalService:  1,
+	} {
+		err = c.WaitForHealthy(name, n, DefaultWaitTimeout)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// 停止所有服务和注册中心，删除临时目录
+func (c *Cluster) Close() {
+	var instances []*Instance
+	if c.Portal != nil {
+		instances = append(instances, c.Portal)
+	}
+	instances = append(instances, c.Grading...)
+	if c.Log != nil {
+		instances = append(instances, c.Log)
+	}
+	for _, inst := range instances {
+		inst.Stop()
+	}
+	c.recorder.close()
+	log.Close()
+	if c.Registry != nil {
+		c.Registry.Close()
+	}
+	if c.tempDir != "" {
+		os.RemoveAll(c.tempDir)
+	}
+}
+
+// 等待服务至少有 n 个健康实例
+func (c *Cluster) WaitForHealthy(name registry.ServiceName, n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		regs, err := registry.LookupServices(c.RegistryURL, name, true)
+		if err == nil && len(regs) >= n {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v has %d healthy instances, want %d: %v", name, len(regs), n, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// 等待实例从注册中心消失（取消注册或者被心跳检查移除）
+func (c *Cluster) WaitForRemoved(inst *Instance, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		regs, err := registry.LookupServices(c.RegistryURL, inst.Name, false)
+		if err == nil && !containsID(regs, inst.ID) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v is still registered: %v", inst.ID, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func containsID(regs []registry.Registration, id string) bool {
+	for _, reg := range regs {
+		if reg.ServiceID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// 不需要关闭通知的路由
+func withoutDone(handlers func(mux *http.ServeMux)) func(mux *http.ServeMux, done <-chan struct{}) {
+	return func(mux *http.ServeMux, _ <-chan struct{}) { handlers(mux) }
+}
+
+// 在随机端口上启动一个服务实例。handlers 注册服务的路由，done 在实例开始停止时关闭
+func (c *Cluster) startInstance(cfg Config, name registry.ServiceName, required []registry.ServiceName,
+	handlers func(mux *http.ServeMux, done <-chan struct{}), opts ...service.Option) (*Instance, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	host, port := addr.IP.String(), fmt.Sprint(addr.Port)
+	serviceURL := fmt.Sprintf("http://%s:%s", host, port)
+
+	inst := &Instance{
+		Name: name,
+		ID:   fmt.Sprintf("%s-%s:%s", name, host, port),
+		URL:  serviceURL,
+		addr: l.Addr().String(),
+	}
+	reg := registry.Registration{
+		ServiceName:      name,
+		ServiceID:        inst.ID,
+		ServiceURL:       serviceURL,
+		RequiredServices: required,
+		ServiceUpdateURL: serviceURL + "/services",
+		HeartbeatURL:     serviceURL + "/heartbeat",
+		Heartbeat:        cfg.Heartbeat,
+	}
+	inst.start = func(l net.Listener) (context.Context, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		inst.cancel = cancel
+		all := append([]service.Option{
+			service.WithListener(l),
+			service.WithDrainPeriod(cfg.DrainPeriod),
+		}, opts...)
+		// 每次启动使用新的上下文，停止时取消，正在推送的长连接随之结束
+		return service.Start(ctx, c.RegistryURL, host, port, reg, func(mux *http.ServeMux) { handlers(mux, ctx.Done()) }, all...)
+	}
+	err = inst.run(l)
+	if err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+// 一个服务实例
+type Instance struct {
+	Name registry.ServiceName
+	ID   string
+	URL  string
+
+	addr  string
+	start func(l net.Listener) (context.Context, error)
+
+	mutex    sync.Mutex
+	listener *killableListener
+	cancel   context.CancelFunc
+	running  bool
+}
+
+func (i *Instance) run(l net.Listener) error {
+	kl := newKillableListener(l)
+	i.listener = kl
+	_, err := i.start(kl)
+	if err != nil {
+		i.cancel()
+		kl.Close()
+		i.listener = nil
+		return err
+	}
+	i.running = true
+	return nil
+}
+
+// 正常停止：取消注册、关闭 HTTP 服务器
+func (i *Instance) Stop() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.stop()
+}
+
+func (i *Instance) stop() {
+	if i.listener == nil {
+		return
+	}
+	i.cancel()
+	// 服务关闭 HTTP 服务器时会关闭监听器，此时已经完成取消注册
+	select {
+	case <-i.listener.closed:
+	case <-time.After(DefaultWaitTimeout):
+	}
+	i.listener = nil
+	i.running = false
+}
+
+// 模拟进程崩溃：不再接受连接，已有的连接全部断开，也不取消注册，由注册中心的心跳检查发现
+func (i *Instance) Kill() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.listener != nil && i.running {
+		i.listener.kill()
+		i.running = false
+	}
+}
+
+// 在原来的地址上重新启动（实例ID不变）；崩溃的实例先清理掉之前的服务
+func (i *Instance) Restart() error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.stop()
+	l, err := net.Listen("tcp", i.addr)
+	if err != nil {
+		return err
+	}
+	return i.run(l)
+}
+
+// 实例当前是否在运行（没有被停止或者模拟崩溃）
+func (i *Instance) Running() bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.running
+}
+
+// 可以模拟崩溃的监听器：kill 后关闭底层监听器和所有连接，但 Accept 一直阻塞而不是返回错误，
+// 否则 HTTP 服务器退出时 service 会取消注册，和真实的崩溃不同
+type killableListener struct {
+	net.Listener
+
+	mutex  sync.Mutex
+	conns  map[net.Conn]struct{}
+	killed bool
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newKillableListener(l net.Listener) *killableListener {
+	return &killableListener{
+		Listener: l,
+		conns:    make(map[net.Conn]struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (l *killableListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		l.mutex.Lock()
+		killed := l.killed
+		if err == nil && !killed {
+			l.conns[conn] = struct{}{}
+			l.mutex.Unlock()
+			return &trackedConn{Conn: conn, l: l}, nil
+		}
+		l.mutex.Unlock()
+
+		switch {
+		case err == nil:
+			// kill 之前刚刚接受的连接
+			conn.Close()
+		case killed:
+			// 等到服务关闭监听器时才返回
+			<-l.closed
+			return nil, net.ErrClosed
+		default:
+			return nil, err
+		}
+	}
+}
+
+func (l *killableListener) kill() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.killed = true
+	l.Listener.Close()
+	for conn := range l.conns {
+		conn.Close()
+	}
+}
+
+func (l *killableListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	l.mutex.Lock()
+	killed := l.killed
+	l.mutex.Unlock()
+	// kill 时已经关闭了底层监听器
+	if killed {
+		return nil
+	}
+	return l.Listener.Close()
+}
+
+type trackedConn struct {
+	net.Conn
+	l *killableListener
+}
+
+func (c *trackedConn) Close() error {
+	c.l.mutex.Lock()
+	delete(c.l.conns, c.Conn)
+	c.l.mutex.Unlock()
+	return c.Conn.Close()
+}
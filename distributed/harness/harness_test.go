@@ -0,0 +1,119 @@
+package harness
+
+import (
+	"distributed/registry"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startCluster(t *testing.T, cfg Config) *Cluster {
+	t.Helper()
+	c, err := Start(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// GET Portal 的 /students，返回状态码和页面内容
+func getStudents(t *testing.T, c *Cluster) (int, string) {
+	t.Helper()
+	res, err := http.Get(c.Portal.URL + "/students")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+func TestStart(t *testing.T) {
+	c := startCluster(t, Config{GradingInstances: 2})
+
+	for name, n := range map[registry.ServiceName]int{
+		registry.LogService:     1,
+		registry.GradingService: 2,
+		registry.PortalService:  1,
+	} {
+		regs, err := registry.LookupServices(c.RegistryURL, name, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(regs) != n {
+			t.Errorf("%v has %d healthy instances, want %d", name, len(regs), n)
+		}
+	}
+	for _, inst := range c.Grading {
+		_, err := c.WaitForPatch(registry.GradingService, DefaultWaitTimeout, Adds(inst.ID))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPortalStudents(t *testing.T) {
+	c := startCluster(t, Config{})
+
+	code, body := getStudents(t, c)
+	if code != http.StatusOK {
+		t.Fatalf("GET /students responded with code %v: %s", code, body)
+	}
+	if !strings.Contains(body, "<table") {
+		t.Errorf("GET /students did not render the student list: %s", body)
+	}
+}
+
+func TestKillAndRestart(t *testing.T) {
+	c := startCluster(t, Config{GradingInstances: 2})
+	victim := c.Grading[0]
+
+	victim.Kill()
+	if victim.Running() {
+		t.Fatal("killed instance is still running")
+	}
+	_, err := c.WaitForPatch(registry.GradingService, DefaultWaitTimeout, Removes(victim.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 剩下的实例继续提供服务
+	code, body := getStudents(t, c)
+	if code != http.StatusOK {
+		t.Fatalf("GET /students with one instance down responded with code %v: %s", code, body)
+	}
+
+	c.ResetPatches()
+	err = victim.Restart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.WaitForPatch(registry.GradingService, DefaultWaitTimeout, Adds(victim.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WaitForHealthy(registry.GradingService, 2, DefaultWaitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	c := startCluster(t, Config{GradingInstances: 2})
+	inst := c.Grading[1]
+
+	inst.Stop()
+	err := c.WaitForRemoved(inst, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.WaitForPatch(registry.GradingService, DefaultWaitTimeout, Removes(inst.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,104 @@
+package harness
+
+// 记录服务收到的补丁。进程内的实例缓存是每个服务各自收到的实例的并集：
+// Added 在每个接收补丁的服务中各记录一次（例如 GradingService 和 Portal 都依赖 LogService 时记录两次）；
+// Removed 只在实例离开缓存时记录一次，其他服务还持有该实例时不记录。
+
+import (
+	"distributed/registry"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type recorder struct {
+	mutex        sync.Mutex
+	patches      map[registry.ServiceName][]registry.Patch
+	changed      chan struct{} // 每次记录时关闭并替换
+	unsubscribes []func()
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		patches: make(map[registry.ServiceName][]registry.Patch),
+		changed: make(chan struct{}),
+	}
+}
+
+func (r *recorder) watch(name registry.ServiceName) {
+	unsubscribe := registry.Subscribe(name, func(p registry.Patch) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.patches[name] = append(r.patches[name], p)
+		close(r.changed)
+		r.changed = make(chan struct{})
+	})
+	r.unsubscribes = append(r.unsubscribes, unsubscribe)
+}
+
+func (r *recorder) close() {
+	for _, unsubscribe := range r.unsubscribes {
+		unsubscribe()
+	}
+}
+
+// 目前为止收到的该服务的补丁（只包含该服务的条目）
+func (c *Cluster) Patches(name registry.ServiceName) []registry.Patch {
+	c.recorder.mutex.Lock()
+	defer c.recorder.mutex.Unlock()
+	return append([]registry.Patch(nil), c.recorder.patches[name]...)
+}
+
+// 清空记录的补丁，之后的 WaitForPatch 只匹配新收到的补丁
+func (c *Cluster) ResetPatches() {
+	c.recorder.mutex.Lock()
+	defer c.recorder.mutex.Unlock()
+	c.recorder.patches = make(map[registry.ServiceName][]registry.Patch)
+}
+
+// 等待收到一个满足 match 的该服务的补丁（包括已经收到的）
+func (c *Cluster) WaitForPatch(name registry.ServiceName, timeout time.Duration, match func(registry.Patch) bool) (registry.Patch, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	seen := 0
+	for {
+		c.recorder.mutex.Lock()
+		patches := c.recorder.patches[name]
+		changed := c.recorder.changed
+		c.recorder.mutex.Unlock()
+
+		for ; seen < len(patches); seen++ {
+			if match(patches[seen]) {
+				return patches[seen], nil
+			}
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return registry.Patch{}, fmt.Errorf("no matching %v patch within %v", name, timeout)
+		}
+	}
+}
+
+// 匹配新增了指定实例的补丁
+func Adds(id string) func(registry.Patch) bool {
+	return func(p registry.Patch) bool {
+		return containsInstance(p.Added, id)
+	}
+}
+
+// 匹配移除了指定实例的补丁
+func Removes(id string) func(registry.Patch) bool {
+	return func(p registry.Patch) bool {
+		return containsInstance(p.Removed, id)
+	}
+}
+
+func containsInstance(instances []registry.Instance, id string) bool {
+	for _, inst := range instances {
+		if inst.ID == id {
+			return true
+		}
+	}
+	return false
+}
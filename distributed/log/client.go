@@ -1,35 +1,218 @@
 package log
+
 import (
-	"bytes"
+	"context"
 	"distributed/registry"
+	"encoding/json"
 	"fmt"
-	"io"
 	stlog "log"
-	"net/http"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 记录到 Record.TraceID 而不是 Fields 的属性名
+const TraceIDKey = "trace_id"
+
+// SetClientLogger 创建的发送器，Flush 使用
+var (
+	clientShipper *Shipper
+	clientMutex   sync.Mutex
 )
 
-// 设置 日志记录器：给 具体的客户端（服务） 提供 日志服务
-func SetClientLogger(serviceURL string, clientService registry.ServiceName) {
-	stlog.SetPrefix(fmt.Sprintf("[%v] - ", clientService))
+// 设置 日志记录器：给 具体的客户端（服务） 提供 日志服务，每次发送时按服务名找到日志服务。
+// slog 的默认 Logger 和标准库 log 包的输出都会异步发送到日志服务，服务关闭前应当调用 Flush。
+func SetClientLogger(clientService registry.ServiceName, instance string, cfg ShipperConfig) {
+	shipper := NewShipper(registry.DefaultClient, cfg)
+	clientMutex.Lock()
+	previous := clientShipper
+	clientShipper = shipper
+	clientMutex.Unlock()
+	// 再次设置时，之前的发送器发送完剩余的记录后停止
+	if previous != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+			defer cancel()
+			previous.Close(ctx)
+		}()
+	}
+	stlog.SetPrefix("")
 	stlog.SetFlags(0)
-	stlog.SetOutput(&clientLogger{url: serviceURL})	// 自动调用write方法
-}
-type clientLogger struct {
-	url string
+	slog.SetDefault(slog.New(NewHandler(clientService, instance, shipper, nil)))
 }
 
-// 这行代码确保 clientLogger 类型实现了 io.Writer 接口
-var _ io.Writer = (*clientLogger)(nil)
+// 发送 SetClientLogger 设置的日志记录器中还没有发送的日志
+func Flush(ctx context.Context) error {
+	clientMutex.Lock()
+	shipper := clientShipper
+	clientMutex.Unlock()
+	if shipper == nil {
+		return nil
+	}
+	return shipper.Flush(ctx)
+}
 
-// 将日志信息通过 HTTP POST 请求发送到指定的日志服务URL
-func (cl clientLogger) Write(data []byte) (int, error) {
-	b := bytes.NewBuffer([]byte(data))
-	res, err := http.Post(cl.url+"/log", "text/plain", b)
+// 健康检查：本地的服务列表中是否有日志服务的实例。只读取注册中心推送的列表，不访问日志服务本身，
+// 实例是否健康由注册中心的心跳检查保证，列表可能比实际状态晚一次推送。
+// 报告 warning 的实例不会被路由流量，只适合离不开日志服务的服务使用
+func CheckProviderKnown() (registry.HealthStatus, string) {
+	logProvider, err := registry.GetProvider(registry.LogService)
 	if err != nil {
-		return 0, err
+		return registry.HealthWarning, err.Error()
+	}
+	return registry.HealthPassing, "log service at " + logProvider
+}
+
+// 将 slog 的记录交给 Shipper 发送到日志服务的 slog.Handler。
+// 属性保存在 Record.Fields 中，分组的属性名用 "." 连接；名为 TraceIDKey 的属性和 ctx 中的 trace ID 记录到 TraceID。
+type Handler struct {
+	service  registry.ServiceName
+	instance string
+	level    slog.Leveler
+	shipper  *Shipper
+
+	fields  map[string]any // WithAttrs 添加的属性
+	traceID string
+	prefix  string // WithGroup 添加的分组
+}
+
+var _ slog.Handler = (*Handler)(nil)
+
+// opts 为空时记录 Info 及以上的级别
+func NewHandler(service registry.ServiceName, instance string, shipper *Shipper, opts *slog.HandlerOptions) *Handler {
+	h := &Handler{
+		service:  service,
+		instance: instance,
+		level:    slog.LevelInfo,
+		shipper:  shipper,
+	}
+	if opts != nil && opts.Level != nil {
+		h.level = opts.Level
+	}
+	return h
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := h.clone()
+	for _, a := range attrs {
+		h2.addAttr(h2.fields, &h2.traceID, h2.prefix, a)
+	}
+	return h2
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := h.clone()
+	h2.prefix = h.prefix + name + "."
+	return h2
+}
+
+func (h *Handler) clone() *Handler {
+	h2 := *h
+	h2.fields = make(map[string]any, len(h.fields))
+	for k, v := range h.fields {
+		h2.fields[k] = v
+	}
+	return &h2
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	rec := Record{
+		Time:     r.Time,
+		Level:    r.Level.String(),
+		Service:  string(h.service),
+		Instance: h.instance,
+		Message:  r.Message,
+		TraceID:  h.traceID,
+	}
+	if id := TraceIDFromContext(ctx); id != "" {
+		rec.TraceID = id
+	}
+	fields := make(map[string]any, len(h.fields)+r.NumAttrs())
+	for k, v := range h.fields {
+		fields[k] = v
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		h.addAttr(fields, &rec.TraceID, h.prefix, a)
+		return true
+	})
+	if len(fields) > 0 {
+		rec.Fields = fields
+	}
+	h.shipper.Enqueue(rec)
+	return nil
+}
+
+// 展开属性：分组内的属性名加上分组前缀
+func (h *Handler) addAttr(fields map[string]any, traceID *string, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix = prefix + a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			h.addAttr(fields, traceID, prefix, ga)
+		}
+		return
+	}
+	if prefix == "" && a.Key == TraceIDKey {
+		*traceID = a.Value.String()
+		return
+	}
+	fields[prefix+a.Key] = fieldValue(a.Value)
+}
+
+// 转换成可以编码为 JSON 的值
+func fieldValue(v slog.Value) any {
+	switch v.Kind() {
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case error:
+			return x.Error()
+		case json.Marshaler:
+			return x
+		case fmt.Stringer:
+			return x.String()
+		}
+		if _, err := json.Marshal(v.Any()); err != nil {
+			return fmt.Sprint(v.Any())
+		}
+		return v.Any()
+	default:
+		return v.Any()
+	}
+}
+
+// 以文本格式输出到标准错误：时间 级别 [服务] 消息 key=value ...
+func writeStderr(rec Record) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s [%s] %s", rec.Time.Format(time.RFC3339), rec.Level, rec.Service, rec.Message)
+	keys := make([]string, 0, len(rec.Fields))
+	for k := range rec.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, rec.Fields[k])
 	}
-	if res.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("failed to send log message. Service responed with code %v", res.StatusCode)
+	if rec.TraceID != "" {
+		fmt.Fprintf(&b, " %s=%s", TraceIDKey, rec.TraceID)
 	}
-	return len(data), nil
+	b.WriteString("\n")
+	_, err := os.Stderr.WriteString(b.String())
+	return err
 }
@@ -0,0 +1,105 @@
+package log
+
+import (
+	"context"
+	"distributed/registry"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestHandlerFlattensAttributes(t *testing.T) {
+	fake := &fakeLogService{}
+	serveLogService(t, fake)
+	s := NewShipper(registry.NewClient(), ShipperConfig{FlushInterval: 10 * time.Millisecond})
+	logger := slog.New(NewHandler("HandlerTest", "http://h", s, nil))
+
+	tests := []struct {
+		name    string
+		log     func(msg string)
+		level   string
+		fields  map[string]any
+		traceID string
+	}{
+		{
+			name:   "record attributes",
+			log:    func(msg string) { logger.Info(msg, "path", "/grades", "count", 3) },
+			level:  LevelInfo,
+			fields: map[string]any{"path": "/grades", "count": float64(3)},
+		},
+		{
+			name: "WithAttrs and WithGroup",
+			log: func(msg string) {
+				logger.With("user", "bob").WithGroup("req").Warn(msg, "id", 7, slog.Group("timing", "ms", 5))
+			},
+			level:  LevelWarn,
+			fields: map[string]any{"user": "bob", "req.id": float64(7), "req.timing.ms": float64(5)},
+		},
+		{
+			name:   "empty group name is ignored",
+			log:    func(msg string) { logger.WithGroup("").Error(msg, slog.Group("", "inline", true)) },
+			level:  LevelError,
+			fields: map[string]any{"inline": true},
+		},
+		{
+			name:   "values without a JSON form",
+			log:    func(msg string) { logger.Info(msg, "err", errors.New("boom"), "took", 1500*time.Millisecond) },
+			level:  LevelInfo,
+			fields: map[string]any{"err": "boom", "took": "1.5s"},
+		},
+		{
+			name:    "trace ID attribute",
+			log:     func(msg string) { logger.With(TraceIDKey, "from-attrs").Info(msg) },
+			level:   LevelInfo,
+			traceID: "from-attrs",
+		},
+		{
+			name: "trace ID in context wins over attributes",
+			log: func(msg string) {
+				ctx := ContextWithTraceID(context.Background(), "from-ctx")
+				logger.With(TraceIDKey, "from-attrs").InfoContext(ctx, msg)
+			},
+			level:   LevelInfo,
+			traceID: "from-ctx",
+		},
+		{
+			name:   "trace ID key inside a group is a field",
+			log:    func(msg string) { logger.WithGroup("upstream").Info(msg, TraceIDKey, "other") },
+			level:  LevelInfo,
+			fields: map[string]any{"upstream." + TraceIDKey: "other"},
+		},
+	}
+	for _, tt := range tests {
+		tt.log(tt.name)
+	}
+	// 低于 Info 的级别不发送
+	logger.Debug("debug is disabled")
+
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]Record)
+	for _, rec := range fake.receivedRecords() {
+		got[rec.Message] = rec
+	}
+	if _, ok := got["debug is disabled"]; ok {
+		t.Error("debug record was shipped")
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, ok := got[tt.name]
+			if !ok {
+				t.Fatal("record was not shipped")
+			}
+			want := Record{Level: tt.level, Service: "HandlerTest", Instance: "http://h", Message: tt.name, Fields: tt.fields, TraceID: tt.traceID}
+			if rec.Time.IsZero() {
+				t.Error("record has no time")
+			}
+			rec.Time = time.Time{}
+			if !sameRecord(rec, want) {
+				t.Errorf("shipped %+v, want %+v", rec, want)
+			}
+		})
+	}
+}
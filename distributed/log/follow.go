@@ -0,0 +1,193 @@
+package log
+
+// 实时查看日志：GET /log/tail 先发送最近的 n 条记录（默认 10 条），之后每写入一条满足条件的记录就以
+// Server-Sent Events 推送给客户端，直到客户端断开或者服务关闭。过滤条件与 GET /log 相同（不支持分页）。
+//
+//	curl -N 'http://localhost:4000/log/tail?service=Portal&level=ERROR&n=0'
+
+import (
+	"encoding/json"
+	stlog "log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 推送相关的参数
+const (
+	DefaultTailLines  = 10
+	followBuffer      = 256              // 每个客户端缓存的记录数，客户端读得太慢时丢弃新的记录
+	keepAliveInterval = 15 * time.Second // 没有新记录时发送注释行，避免连接被代理断开
+)
+
+// 正在实时查看日志的客户端
+type follower struct {
+	query   Query
+	records chan Record
+	dropped int // 因为缓存已满丢弃的记录数
+}
+
+var (
+	followers     = make(map[*follower]struct{})
+	followerMutex sync.Mutex
+)
+
+// 开始接收新写入的记录，同时返回此时日志的快照：之前的记录在快照中，之后的记录从通道中收到
+func follow(q Query) (*follower, *logSnapshot, error) {
+	f := &follower{query: q, records: make(chan Record, followBuffer)}
+	// 持有写日志的锁，保证订阅和快照对应同一个时刻
+	mutex.Lock()
+	defer mutex.Unlock()
+	snap, err := takeSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	followerMutex.Lock()
+	followers[f] = struct{}{}
+	followerMutex.Unlock()
+	return f, snap, nil
+}
+
+func unfollow(f *follower) {
+	followerMutex.Lock()
+	delete(followers, f)
+	followerMutex.Unlock()
+}
+
+// 把新写入的记录发给满足条件的客户端，不会阻塞写日志
+func publish(rec Record) {
+	followerMutex.Lock()
+	defer followerMutex.Unlock()
+	for f := range followers {
+		if !f.query.match(rec) {
+			continue
+		}
+		select {
+		case f.records <- rec:
+		default:
+			f.dropped++
+		}
+	}
+}
+
+// 取出并清零丢弃的记录数
+func (f *follower) takeDropped() int {
+	followerMutex.Lock()
+	defer followerMutex.Unlock()
+	n := f.dropped
+	f.dropped = 0
+	return n
+}
+
+// GET /log/tail，done 关闭时结束推送
+func serveTail(w http.ResponseWriter, r *http.Request, done <-chan struct{}) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	values := r.URL.Query()
+	q, err := parseQuery(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := intParam(values, "n", DefaultTailLines)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n = min(n, MaxPageSize)
+
+	// 先订阅再读取订阅之前的记录，两者之间写入的记录既不会丢失也不会重复
+	f, snap, err := follow(q)
+	if err != nil {
+		stlog.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer unfollow(f)
+	backlog, err := lastRecords(snap, q, n)
+	snap.close()
+	if err != nil {
+		stlog.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, rec := range backlog {
+		if writeEvent(w, "", rec) != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case rec := <-f.records:
+			if dropped := f.takeDropped(); dropped > 0 {
+				if writeEvent(w, "dropped", dropped) != nil {
+					return
+				}
+			}
+			if writeEvent(w, "", rec) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// 快照中满足条件的最后 n 条记录
+func lastRecords(snap *logSnapshot, q Query, n int) ([]Record, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	ring := make([]Record, 0, n)
+	start := 0
+	err := snap.scan(func(rec Record) bool {
+		if !q.match(rec) {
+			return true
+		}
+		if len(ring) < n {
+			ring = append(ring, rec)
+		} else {
+			ring[start] = rec
+			start = (start + 1) % n
+		}
+		return true
+	})
+	return append(ring[start:], ring[:start]...), err
+}
+
+// 写一个 SSE 事件，event 为空时是普通的日志记录
+func writeEvent(w http.ResponseWriter, event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if event != "" {
+		if _, err = w.Write([]byte("event: " + event + "\n")); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write([]byte("data: " + string(data) + "\n\n"))
+	return err
+}
@@ -0,0 +1,72 @@
+package log
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTailEndsWhenDoneIsClosed(t *testing.T) {
+	err := Run(filepath.Join(t.TempDir(), "distributed.log"), RotationPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Close() })
+	done := make(chan struct{})
+	mux := http.NewServeMux()
+	RegisterHandlers(mux, done)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/log/tail?n=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	// 推送中的记录能够收到
+	err = write(Record{Service: "TailTest", Message: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+	}()
+	timeout := time.After(5 * time.Second)
+	for received := false; !received; {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("stream ended before the record was pushed")
+			}
+			received = strings.Contains(line, "hello")
+		case <-timeout:
+			t.Fatal("record was not pushed")
+		}
+	}
+
+	// 客户端没有断开，done 关闭后服务端结束响应
+	close(done)
+	for {
+		select {
+		case _, ok := <-lines:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("tail did not end after done was closed")
+		}
+	}
+}
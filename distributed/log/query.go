@@ -0,0 +1,312 @@
+package log
+
+// 查询日志：GET /log 按条件在日志文件中查找记录，按写入顺序（从旧到新）分页返回。
+//
+//	GET /log?service=Portal&level=WARN&from=2024-05-01T00:00:00Z&q=timeout&limit=50
+//	GET /log?regex=student [0-9]+&offset=50
+//
+// 参数：from、to 为 RFC3339 时间（from 包含，to 不包含）；service 可以出现多次；
+// level 为最低级别；q 为消息中包含的子串（不区分大小写）；regex 为消息匹配的正则表达式；
+// trace 为 trace ID；limit 为每页的条数，offset 为跳过的条数，使用上一页返回的 Next 即可。
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	stlog "log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 分页大小
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// 查询条件，零值表示不限制
+type Query struct {
+	From     time.Time
+	To       time.Time
+	Services []string
+	Level    *slog.Level // 最低级别
+	Contains string      // 小写的子串
+	Regexp   *regexp.Regexp
+	TraceID  string
+}
+
+// 查询结果的一页
+type Page struct {
+	Records []Record
+	Next    int // 下一页的 offset，没有更多记录时为 0
+}
+
+// 从请求参数解析查询条件
+func parseQuery(v url.Values) (Query, error) {
+	var q Query
+	var err error
+	if s := v.Get("from"); s != "" {
+		q.From, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		q.To, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	q.Services = v["service"]
+	if s := v.Get("level"); s != "" {
+		var level slog.Level
+		err = level.UnmarshalText([]byte(s))
+		if err != nil {
+			return q, err
+		}
+		q.Level = &level
+	}
+	q.Contains = strings.ToLower(v.Get("q"))
+	if s := v.Get("regex"); s != "" {
+		q.Regexp, err = regexp.Compile(s)
+		if err != nil {
+			return q, err
+		}
+	}
+	q.TraceID = v.Get("trace")
+	return q, nil
+}
+
+// 记录是否满足查询条件
+func (q Query) match(rec Record) bool {
+	if !q.From.IsZero() && rec.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !rec.Time.Before(q.To) {
+		return false
+	}
+	if len(q.Services) > 0 && !containsString(q.Services, rec.Service) {
+		return false
+	}
+	if q.Level != nil {
+		var level slog.Level
+		if level.UnmarshalText([]byte(rec.Level)) != nil || level < *q.Level {
+			return false
+		}
+	}
+	if q.Contains != "" && !strings.Contains(strings.ToLower(rec.Message), q.Contains) {
+		return false
+	}
+	if q.Regexp != nil && !q.Regexp.MatchString(rec.Message) {
+		return false
+	}
+	if q.TraceID != "" && rec.TraceID != q.TraceID {
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 日志在某一时刻的内容：当时已经切割出的文件，加上当前文件的前 size 字节。
+// 当前文件在持有 mutex 时打开，之后即使被切割（重命名）或者压缩（删除），仍然可以通过打开的文件读取
+type logSnapshot struct {
+	segments []string
+	current  *os.File
+	size     int64
+}
+
+// 调用方持有 mutex
+func takeSnapshot() (*logSnapshot, error) {
+	if output == nil {
+		return &logSnapshot{}, nil
+	}
+	segments, err := output.segments()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(output.path)
+	if os.IsNotExist(err) {
+		return &logSnapshot{segments: segments}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &logSnapshot{segments: segments, current: f, size: output.size}, nil
+}
+
+func (s *logSnapshot) close() {
+	if s.current != nil {
+		s.current.Close()
+	}
+}
+
+// 从旧到新依次读取记录，fn 返回 false 时停止。
+// 不是 JSON 的行（旧版本写入的纯文本日志）按纯文本记录处理；最后一行还没有写完时忽略。
+func (s *logSnapshot) scan(fn func(Record) bool) error {
+	stopped := false
+	visit := func(rec Record) bool {
+		stopped = !fn(rec)
+		return !stopped
+	}
+	for _, segment := range s.segments {
+		err := scanSegment(segment, visit)
+		if err != nil {
+			return err
+		}
+		if stopped {
+			return nil
+		}
+	}
+	if s.current == nil {
+		return nil
+	}
+	return readRecords(io.NewSectionReader(s.current, 0, s.size), visit)
+}
+
+// 读取一个切割出的文件。列出之后被压缩的文件改读压缩后的 .gz，读取之前已经被清理掉的文件跳过
+func scanSegment(segment string, fn func(Record) bool) error {
+	f, err := os.Open(segment)
+	if os.IsNotExist(err) && !strings.HasSuffix(segment, ".gz") {
+		segment += ".gz"
+		f, err = os.Open(segment)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(segment, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	return readRecords(r, fn)
+}
+
+// 读取当前所有的日志
+func scanRecords(fn func(Record) bool) error {
+	mutex.Lock()
+	snap, err := takeSnapshot()
+	mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	defer snap.close()
+	return snap.scan(fn)
+}
+
+func readRecords(r io.Reader, fn func(Record) bool) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var rec Record
+		if json.Unmarshal(line, &rec) != nil {
+			rec = textRecord(string(line))
+		}
+		if !fn(rec) {
+			return nil
+		}
+	}
+}
+
+// 按条件分页查询
+func search(q Query, offset, limit int) (Page, error) {
+	page := Page{Records: []Record{}}
+	skipped := 0
+	err := scanRecords(func(rec Record) bool {
+		if !q.match(rec) {
+			return true
+		}
+		if skipped < offset {
+			skipped++
+			return true
+		}
+		if len(page.Records) == limit {
+			// 还有更多的记录
+			page.Next = offset + limit
+			return false
+		}
+		page.Records = append(page.Records, rec)
+		return true
+	})
+	return page, err
+}
+
+// 解析非负整数参数，缺省时为 def
+func intParam(v url.Values, name string, def int) (int, error) {
+	s := v.Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, s)
+	}
+	return n, nil
+}
+
+// GET /log
+func serveQuery(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	q, err := parseQuery(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, err := intParam(values, "offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := intParam(values, "limit", DefaultPageSize)
+	if err != nil || limit == 0 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	limit = min(limit, MaxPageSize)
+
+	page, err := search(q, offset, limit)
+	if err != nil {
+		stlog.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(page)
+	if err != nil {
+		stlog.Println(err)
+	}
+}
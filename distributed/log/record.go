@@ -0,0 +1,67 @@
+package log
+
+// 结构化的日志记录：客户端以 JSON 发送到 /log，日志服务按行保存为 JSON（JSON lines）。
+// 旧的客户端发送的纯文本消息也会转换成一条记录。
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// 日志级别，与 log/slog 的级别名称一致
+const (
+	LevelDebug = "DEBUG"
+	LevelInfo  = "INFO"
+	LevelWarn  = "WARN"
+	LevelError = "ERROR"
+)
+
+// 一条日志记录
+type Record struct {
+	Time     time.Time
+	Level    string
+	Service  string // 服务名
+	Instance string // 实例，例如服务地址
+	Message  string
+	Fields   map[string]any // 任意的键值对
+	TraceID  string         // 跨服务关联同一个请求的日志
+}
+
+// 纯文本消息转换成记录：旧的客户端会加上 "[服务名] - " 前缀
+func textRecord(msg string) Record {
+	rec := Record{Level: LevelInfo, Message: strings.TrimRight(msg, "\r\n")}
+	if strings.HasPrefix(rec.Message, "[") {
+		if i := strings.Index(rec.Message, "] - "); i > 0 {
+			rec.Service = rec.Message[1:i]
+			rec.Message = rec.Message[i+len("] - "):]
+		}
+	}
+	return rec
+}
+
+// 补全缺省的时间和级别
+func (rec *Record) normalize() {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Level = strings.ToUpper(rec.Level)
+	if rec.Level == "" {
+		rec.Level = LevelInfo
+	}
+}
+
+type traceIDKey struct{}
+
+// 在 ctx 中携带 trace ID，通过 slog 的 ...Context 方法写日志时记录到 TraceID
+func ContextWithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+func TraceIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
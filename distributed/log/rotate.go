@@ -0,0 +1,268 @@
+package log
+
+// 日志文件的切割和保留：当前文件保持打开，超过大小或者跨天时重命名为带时间戳的文件
+// （distributed.log -> distributed-20240501T120000.000000.log），之后在后台压缩并清理过期的文件。
+// 查询时按时间顺序读取切割出的文件和当前文件。
+
+import (
+	"compress/gzip"
+	"io"
+	stlog "log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 切割和保留策略，零值表示不切割、不清理
+type RotationPolicy struct {
+	MaxSize      int64         // 当前文件超过多少字节时切割，0 表示不按大小切割
+	Daily        bool          // 每天（本地时间）切割一次
+	Compress     bool          // 用 gzip 压缩切割出的文件
+	MaxAge       time.Duration // 切割出的文件保留多长时间，0 表示不限制
+	MaxTotalSize int64         // 切割出的文件总共最多占用多少字节，超过时删除最旧的，0 表示不限制
+}
+
+// 切割出的文件名中的时间戳
+const segmentTimeLayout = "20060102T150405.000000"
+
+// 日志文件。方法由调用方持有 mutex 时调用
+type fileLog struct {
+	path   string
+	policy RotationPolicy
+	file   *os.File
+	size   int64
+	day    time.Time // 当前文件开始写入的日期，用于按天切割
+
+	maintenance sync.Mutex // 压缩和清理在后台依次执行
+}
+
+func openFileLog(path string, policy RotationPolicy) (*fileLog, error) {
+	fl := &fileLog{path: path, policy: policy}
+	err := fl.open()
+	if err != nil {
+		return nil, err
+	}
+	// 上次运行时没有完成的压缩和清理
+	go fl.maintain()
+	return fl, nil
+}
+
+// 打开（或者创建）当前文件，已有的内容按最后修改时间计算日期
+func (fl *fileLog) open() error {
+	f, err := os.OpenFile(fl.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	fl.file = f
+	fl.size = info.Size()
+	fl.day = startOfDay(time.Now())
+	if fl.size > 0 {
+		fl.day = startOfDay(info.ModTime())
+	}
+	return nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// 写入一条或多条完整的记录，写之前按需要切割
+func (fl *fileLog) Write(data []byte) (int, error) {
+	if fl.file == nil {
+		err := fl.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if fl.shouldRotate(len(data)) {
+		err := fl.rotate()
+		if err != nil {
+			// 切割失败时继续写入当前文件，不丢日志
+			stlog.Println(err)
+		}
+	}
+	n, err := fl.file.Write(data)
+	fl.size += int64(n)
+	return n, err
+}
+
+func (fl *fileLog) shouldRotate(n int) bool {
+	if fl.size == 0 {
+		return false
+	}
+	if fl.policy.MaxSize > 0 && fl.size+int64(n) > fl.policy.MaxSize {
+		return true
+	}
+	return fl.policy.Daily && startOfDay(time.Now()).After(fl.day)
+}
+
+// 关闭当前文件、重命名为带时间戳的文件，再打开一个新的当前文件
+func (fl *fileLog) rotate() error {
+	err := fl.file.Close()
+	fl.file = nil
+	if err != nil {
+		return err
+	}
+	ext := filepath.Ext(fl.path)
+	segment := strings.TrimSuffix(fl.path, ext) + "-" + time.Now().Format(segmentTimeLayout) + ext
+	err = os.Rename(fl.path, segment)
+	if err != nil {
+		// 重新打开原来的文件继续写
+		if oerr := fl.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	err = fl.open()
+	if err != nil {
+		return err
+	}
+	go fl.maintain()
+	return nil
+}
+
+// 重新打开当前文件，例如外部工具移走了日志文件之后（SIGHUP）
+func (fl *fileLog) reopen() error {
+	if fl.file != nil {
+		fl.file.Close()
+		fl.file = nil
+	}
+	return fl.open()
+}
+
+func (fl *fileLog) close() error {
+	if fl.file == nil {
+		return nil
+	}
+	err := fl.file.Close()
+	fl.file = nil
+	return err
+}
+
+// 切割出的文件，按时间从旧到新排列；同一个文件的压缩版本已经生成时只返回压缩版本
+func (fl *fileLog) segments() ([]string, error) {
+	ext := filepath.Ext(fl.path)
+	prefix := filepath.Base(strings.TrimSuffix(fl.path, ext)) + "-"
+	entries, err := os.ReadDir(filepath.Dir(fl.path))
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if _, ok := segmentTime(name, prefix, ext); ok {
+			names[name] = true
+		}
+	}
+	var segments []string
+	for name := range names {
+		if !strings.HasSuffix(name, ".gz") && names[name+".gz"] {
+			continue
+		}
+		segments = append(segments, filepath.Join(filepath.Dir(fl.path), name))
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// 从切割出的文件名中解析时间戳，例如 distributed-20240501T120000.000000.log.gz
+func segmentTime(name, prefix, ext string) (time.Time, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return time.Time{}, false
+	}
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz")
+	if !strings.HasSuffix(stamp, ext) {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(segmentTimeLayout, strings.TrimSuffix(stamp, ext), time.Local)
+	return t, err == nil
+}
+
+// 压缩切割出的文件，删除超过保留时间或者总大小的文件
+func (fl *fileLog) maintain() {
+	fl.maintenance.Lock()
+	defer fl.maintenance.Unlock()
+
+	segments, err := fl.segments()
+	if err != nil {
+		stlog.Println(err)
+		return
+	}
+	if fl.policy.Compress {
+		for i, segment := range segments {
+			if strings.HasSuffix(segment, ".gz") {
+				continue
+			}
+			err := compress(segment)
+			if err != nil {
+				stlog.Println(err)
+				continue
+			}
+			segments[i] = segment + ".gz"
+		}
+	}
+
+	ext := filepath.Ext(fl.path)
+	prefix := filepath.Base(strings.TrimSuffix(fl.path, ext)) + "-"
+	var total int64
+	// 从新到旧累计大小，超过限制之后的文件都删除
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		info, err := os.Stat(segment)
+		if err != nil {
+			continue
+		}
+		t, _ := segmentTime(filepath.Base(segment), prefix, ext)
+		total += info.Size()
+		expired := fl.policy.MaxAge > 0 && time.Since(t) > fl.policy.MaxAge
+		tooLarge := fl.policy.MaxTotalSize > 0 && total > fl.policy.MaxTotalSize
+		if expired || tooLarge {
+			err := os.Remove(segment)
+			if err != nil {
+				stlog.Println(err)
+			}
+		}
+	}
+}
+
+// 压缩为 segment.gz：先写临时文件再重命名，最后删除原文件
+func compress(segment string) error {
+	src, err := os.Open(segment)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(segment), filepath.Base(segment)+".gz.tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	zw := gzip.NewWriter(tmp)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), segment+".gz")
+	if err != nil {
+		return err
+	}
+	return os.Remove(segment)
+}
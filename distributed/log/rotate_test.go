@@ -0,0 +1,137 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 读取日志文件中的每一行，每一行都必须是一条完整的 JSON 记录
+func readLines(t *testing.T, path string) []Record {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	var recs []Record
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("torn line in %s: %q", filepath.Base(path), sc.Text())
+		}
+		recs = append(recs, rec)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+func TestRotationUnderConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "distributed.log")
+	// 上次运行留下的过期文件
+	old := filepath.Join(dir, "distributed-20000101T000000.000000.log")
+	if err := os.WriteFile(old, []byte(`{"Message":"old"}`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Run(path, RotationPolicy{MaxSize: 4 << 10, Compress: true, MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Close() })
+	mux := http.NewServeMux()
+	RegisterHandlers(mux, nil)
+
+	const writers, perWriter = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				body, _ := json.Marshal(Record{Service: "RotateTest", Message: fmt.Sprintf("writer %d line %d %s", w, i, strings.Repeat("x", 40))})
+				req := httptest.NewRequest(http.MethodPost, "/log", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				rec := httptest.NewRecorder()
+				mux.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Errorf("write responded with code %v", rec.Code)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// 压缩和清理在后台进行：等待所有切割出的文件都压缩、过期的文件被删除
+	mutex.Lock()
+	fl := output
+	mutex.Unlock()
+	deadline := time.Now().Add(10 * time.Second)
+	var segments []string
+	for {
+		fl.maintenance.Lock()
+		segments, err = fl.segments()
+		fl.maintenance.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := len(segments) > 0
+		for _, segment := range segments {
+			if !strings.HasSuffix(segment, ".gz") || strings.HasPrefix(filepath.Base(segment), "distributed-2000") {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("segments were not compressed and pruned: %v", segments)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(segments) < 2 {
+		t.Fatalf("expected several rotations, got segments %v", segments)
+	}
+
+	seen := make(map[string]int)
+	for _, file := range append(segments, path) {
+		for _, rec := range readLines(t, file) {
+			seen[rec.Message]++
+		}
+	}
+	if seen["old"] != 0 {
+		t.Error("expired segment was not pruned")
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < perWriter; i++ {
+			msg := fmt.Sprintf("writer %d line %d %s", w, i, strings.Repeat("x", 40))
+			if seen[msg] != 1 {
+				t.Errorf("%q written %d times", msg[:len(msg)-40], seen[msg])
+			}
+		}
+	}
+}
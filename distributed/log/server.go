@@ -1,49 +1,94 @@
 package log
 
-// 实现一个简单的日志服务
+// 实现一个简单的日志服务：/log 接收 JSON 格式的结构化记录或者纯文本消息，
+// 每条记录以一行 JSON 追加到日志文件
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
 	stlog "log"
+	"mime"
 	"net/http"
-	"os"
+	"sync"
 )
 
-// 定义全局的 logger 日志记录器
-var log *stlog.Logger
+// 日志请求的最大长度
+const (
+	maxRecordSize = 1 << 20
+	maxBatchSize  = 16 << 20
+)
 
-// 定义 fileLog类型 新类型 取代名是“=”
-type fileLog string
+// 日志文件，由 Run 指定。写日志、切割、重新打开都持有 mutex，并发的请求不会交错或者写到已经关闭的文件
+var (
+	output *fileLog
+	mutex  sync.Mutex
+)
 
-// fileLog 实现 Write 方法：用于将日志数据写入指定的文件。
-func (fl fileLog) Write (data []byte)(int, error){
-	// os.Open(): 以只读模式打开；os.OpenFile(): filename，打开模式，指定文件的权限
-	f, err := os.OpenFile(string(fl), os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0600)
+// 打开日志文件，按 policy 切割和清理；文件在 Close 之前一直保持打开
+func Run(dest string, policy RotationPolicy) error {
+	fl, err := openFileLog(dest, policy)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if output != nil {
+		output.close()
 	}
-	// 文件资源打开后，最后关闭
-	defer f.Close()
-	return f.Write(data)
+	output = fl
+	return nil
 }
 
-// 创建新的日志记录器、指定输出位置
-func Run(dest string) {
-	// new : 创建一个新的logger，参数指定：输出路径, 日志记录的固定前缀, 日志的选项：flag
-	log = stlog.New(fileLog(dest),"[go] - ",stlog.LstdFlags)
+// 重新打开日志文件，用于外部的 logrotate 等工具移走文件之后（通常收到 SIGHUP 时调用）
+func Reopen() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if output == nil {
+		return nil
+	}
+	return output.reopen()
 }
 
-// 注册一个http处理程序：处理 log 路径的 POST 请求，将请求体中的消息写入日志。
-func RegisterHandlers() {
-	http.HandleFunc("/log",func(w http.ResponseWriter, r *http.Request) {
+// 关闭日志文件，之后写日志返回错误
+func Close() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if output == nil {
+		return nil
+	}
+	err := output.close()
+	output = nil
+	return err
+}
+
+// 在服务的 mux 上注册一个http处理程序：处理 log 路径的 POST 请求，将请求体中的记录写入日志。
+// Content-Type 为 application/json 时请求体是一条 Record，否则按纯文本处理。
+// POST /log/batch 一次写入多条记录（JSON 数组）；GET /log 查询日志，GET /log/tail 以 SSE 推送新的日志。
+// done 在服务开始关闭时关闭，正在推送的 /log/tail 随之结束，否则关闭时要等到超时；为 nil 时只在客户端断开时结束。
+func RegisterHandlers(mux *http.ServeMux, done <-chan struct{}) {
+	mux.HandleFunc("/log/tail", func(w http.ResponseWriter, r *http.Request) {
+		serveTail(w, r, done)
+	})
+	mux.HandleFunc("/log/batch", serveBatch)
+	mux.HandleFunc("/log",func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
+		case http.MethodGet:
+			serveQuery(w, r)
 		case http.MethodPost:
-			msg, err := io.ReadAll(r.Body)
-			if err != nil || len(msg) == 0 {
+			rec, err := readRecord(w, r)
+			if err != nil {
+				stlog.Println(err)
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			write(string(msg))
+			err = write(rec)
+			if err != nil {
+				stlog.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
@@ -51,7 +96,79 @@ func RegisterHandlers() {
 	})
 }
 
-// 写入日志的函数
-func write(msg string) {
-	log.Printf("%v\n",msg)
-}
\ No newline at end of file
+// 从请求体中读取一条记录
+func readRecord(w http.ResponseWriter, r *http.Request) (Record, error) {
+	body := http.MaxBytesReader(w, r.Body, maxRecordSize)
+	var rec Record
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		err := json.NewDecoder(body).Decode(&rec)
+		if err != nil {
+			return Record{}, err
+		}
+	} else {
+		msg, err := io.ReadAll(body)
+		if err != nil {
+			return Record{}, err
+		}
+		rec = textRecord(string(msg))
+	}
+	if rec.Message == "" {
+		return Record{}, errors.New("log record without message")
+	}
+	rec.normalize()
+	return rec, nil
+}
+
+// POST /log/batch：请求体为 Record 的 JSON 数组，全部有效时一起写入，否则都不写入
+func serveBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var recs []Record
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchSize)).Decode(&recs)
+	if err != nil {
+		stlog.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for i := range recs {
+		if recs[i].Message == "" {
+			http.Error(w, "log record without message", http.StatusBadRequest)
+			return
+		}
+		recs[i].normalize()
+	}
+	err = write(recs...)
+	if err != nil {
+		stlog.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// 每条记录以一行 JSON 写入日志，加锁保证并发请求的记录不会交错；同一批记录一次写入
+func write(recs ...Record) error {
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if output == nil {
+		return errors.New("log service is not running")
+	}
+	_, err := output.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		publish(rec)
+	}
+	return nil
+}
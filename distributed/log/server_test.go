@@ -0,0 +1,143 @@
+package log
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 在临时文件上运行日志服务，返回注册了处理程序的 mux 和日志文件
+func runLogService(t *testing.T) (*http.ServeMux, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "distributed.log")
+	err := Run(path, RotationPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Close() })
+	mux := http.NewServeMux()
+	RegisterHandlers(mux, nil)
+	return mux, path
+}
+
+func post(t *testing.T, mux *http.ServeMux, path, contentType, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestPostRecord(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		code        int
+		want        Record // 不比较 Time，只检查它被补全
+	}{
+		{
+			name:        "json record",
+			contentType: "application/json",
+			body:        `{"Level":"warn","Service":"Portal","Instance":"http://p","Message":"slow","Fields":{"ms":12},"TraceID":"t1"}`,
+			code:        http.StatusOK,
+			want:        Record{Level: LevelWarn, Service: "Portal", Instance: "http://p", Message: "slow", Fields: map[string]any{"ms": float64(12)}, TraceID: "t1"},
+		},
+		{
+			name:        "json with charset",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"Message":"default level"}`,
+			code:        http.StatusOK,
+			want:        Record{Level: LevelInfo, Message: "default level"},
+		},
+		{
+			name:        "plain text with service prefix",
+			contentType: "text/plain",
+			body:        "[GradingService] - grade added\n",
+			code:        http.StatusOK,
+			want:        Record{Level: LevelInfo, Service: "GradingService", Message: "grade added"},
+		},
+		{
+			name: "plain text without content type",
+			body: "just a line",
+			code: http.StatusOK,
+			want: Record{Level: LevelInfo, Message: "just a line"},
+		},
+		{name: "json without message", contentType: "application/json", body: `{"Level":"INFO"}`, code: http.StatusBadRequest},
+		{name: "malformed json", contentType: "application/json", body: `{"Message":`, code: http.StatusBadRequest},
+		{name: "empty text", contentType: "text/plain", body: "", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, path := runLogService(t)
+			before := time.Now()
+			if code := post(t, mux, "/log", tt.contentType, tt.body); code != tt.code {
+				t.Fatalf("POST /log responded with %d, want %d", code, tt.code)
+			}
+			recs := readLines(t, path)
+			if tt.code != http.StatusOK {
+				if len(recs) != 0 {
+					t.Errorf("rejected request wrote %v", recs)
+				}
+				return
+			}
+			if len(recs) != 1 {
+				t.Fatalf("wrote %d records, want 1", len(recs))
+			}
+			got := recs[0]
+			if got.Time.Before(before.Add(-time.Second)) {
+				t.Errorf("time was not filled in: %v", got.Time)
+			}
+			got.Time = time.Time{}
+			if !sameRecord(got, tt.want) {
+				t.Errorf("wrote %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostBatch(t *testing.T) {
+	mux, path := runLogService(t)
+	body := `[{"Message":"first","Level":"debug"},{"Time":"2024-05-01T10:00:00Z","Message":"second","Service":"Portal"}]`
+	if code := post(t, mux, "/log/batch", "application/json", body); code != http.StatusOK {
+		t.Fatalf("POST /log/batch responded with %d", code)
+	}
+	// 有一条无效的记录时整批都不写入
+	if code := post(t, mux, "/log/batch", "application/json", `[{"Message":"third"},{"Level":"INFO"}]`); code != http.StatusBadRequest {
+		t.Fatalf("batch with an invalid record responded with %d", code)
+	}
+	if code := post(t, mux, "/log/batch", "application/json", `{"Message":"not an array"}`); code != http.StatusBadRequest {
+		t.Fatalf("batch that is not an array responded with %d", code)
+	}
+
+	recs := readLines(t, path)
+	if len(recs) != 2 {
+		t.Fatalf("wrote %v, want the two records of the first batch", recs)
+	}
+	if recs[0].Message != "first" || recs[0].Level != LevelDebug || recs[0].Time.IsZero() {
+		t.Errorf("first record %+v", recs[0])
+	}
+	want := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	if recs[1].Message != "second" || recs[1].Level != LevelInfo || recs[1].Service != "Portal" || !recs[1].Time.Equal(want) {
+		t.Errorf("second record %+v", recs[1])
+	}
+}
+
+func sameRecord(a, b Record) bool {
+	if a.Time != b.Time || a.Level != b.Level || a.Service != b.Service || a.Instance != b.Instance ||
+		a.Message != b.Message || a.TraceID != b.TraceID || len(a.Fields) != len(b.Fields) {
+		return false
+	}
+	for k, v := range b.Fields {
+		if a.Fields[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,372 @@
+package log
+
+// 客户端异步发送日志：写日志只是放入有界的内存队列，后台按条数和时间攒成一批发送到 /log/batch。
+// 每次发送都通过注册中心解析 LogService 的实例，日志服务迁移或者重启后自动发到新的实例。
+// 发送失败时按指数退避重试；配置了 spool 文件时，发不出去的记录先追加到文件，日志服务恢复后按顺序补发，
+// 进程重启后也会继续补发。没有日志服务的实例时记录同时写到标准错误输出，实例出现（收到补丁）后立即补发缓存的记录。
+// 队列满时记录直接写到标准错误输出，写日志永远不会阻塞调用方。
+
+import (
+	"bytes"
+	"context"
+	"distributed/registry"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 发送的默认参数
+const (
+	DefaultQueueSize     = 10000
+	DefaultBatchSize     = 100
+	DefaultFlushInterval = time.Second
+	DefaultMaxBackoff    = 30 * time.Second
+	minBackoff           = 500 * time.Millisecond
+	sendTimeout          = 3 * time.Second // 发送一批日志的超时时间（包括换实例重试）
+)
+
+// 发送参数，零值使用默认值
+type ShipperConfig struct {
+	QueueSize     int           // 内存队列最多缓存的记录数
+	BatchSize     int           // 每批最多发送的记录数，攒够时立即发送
+	FlushInterval time.Duration // 不够一批时最多等待多长时间发送
+	MaxBackoff    time.Duration // 重试间隔的上限
+	SpoolFile     string        // 日志服务不可用时保存记录的文件，为空时不落盘
+}
+
+// 把记录批量发送到日志服务
+type Shipper struct {
+	client  *registry.Client
+	cfg     ShipperConfig
+	queue   chan Record
+	flushes chan chan error
+	wake    chan struct{} // LogService 出现新的实例时通知重试
+	done    chan struct{}
+	spilled atomic.Int64 // 因为队列已满写到标准错误输出的记录数
+	closed  atomic.Bool
+
+	unsubscribe func()
+	closeOnce   sync.Once
+}
+
+func NewShipper(client *registry.Client, cfg ShipperConfig) *Shipper {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+	s := &Shipper{
+		client:  client,
+		cfg:     cfg,
+		queue:   make(chan Record, cfg.QueueSize),
+		flushes: make(chan chan error),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	s.unsubscribe = registry.Subscribe(registry.LogService, func(p registry.Patch) {
+		if len(p.Added) == 0 {
+			return
+		}
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	})
+	go s.run()
+	return s
+}
+
+// 放入发送队列，不会阻塞；队列已满或者已经关闭时写到标准错误输出。
+// 没有日志服务的实例时先在本地输出，记录仍然放入队列，日志服务出现后补发
+func (s *Shipper) Enqueue(rec Record) {
+	if s.closed.Load() {
+		writeStderr(rec)
+		return
+	}
+	local := !hasProvider()
+	if local {
+		writeStderr(rec)
+	}
+	select {
+	case s.queue <- rec:
+	default:
+		s.spilled.Add(1)
+		if !local {
+			writeStderr(rec)
+		}
+	}
+}
+
+// 是否发现了日志服务的实例
+func hasProvider() bool {
+	_, err := registry.GetProviders(registry.LogService)
+	return err == nil
+}
+
+// 因为队列已满而写到标准错误输出的记录数
+func (s *Shipper) Spilled() int64 {
+	return s.spilled.Load()
+}
+
+// 立即发送队列中和 spool 文件中的所有记录（忽略退避），等待发送完成或者 ctx 取消。
+// 服务关闭前调用；发送失败时记录保存到 spool 文件，没有 spool 文件时写到标准错误输出。
+func (s *Shipper) Flush(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case s.flushes <- reply:
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 发送剩余的记录并停止后台发送，之后的记录写到标准错误输出
+func (s *Shipper) Close(ctx context.Context) error {
+	s.closed.Store(true)
+	err := s.Flush(ctx)
+	s.closeOnce.Do(func() {
+		s.unsubscribe()
+		close(s.done)
+	})
+	return err
+}
+
+func (s *Shipper) run() {
+	var (
+		buf     []Record  // 已经从队列中取出、还没有发送成功的记录
+		retryAt time.Time // 退避结束的时间
+		backoff time.Duration
+	)
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		// 没有 spool 文件时，未发送的记录攒够一批后不再从队列中取，队列满了由 Enqueue 写到标准错误输出
+		queue := s.queue
+		if s.cfg.SpoolFile == "" && len(buf) >= s.cfg.BatchSize {
+			queue = nil
+		}
+		select {
+		case rec := <-queue:
+			buf = append(buf, rec)
+			if len(buf) < s.cfg.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-s.wake:
+			// 日志服务有了新的实例，不再等待退避结束
+			retryAt, backoff = time.Time{}, 0
+		case <-s.done:
+			return
+		case reply := <-s.flushes:
+			buf = s.drainQueue(buf)
+			err := s.ship(&buf)
+			if err != nil {
+				s.saveUnsent(buf)
+				buf = nil
+			} else {
+				retryAt, backoff = time.Time{}, 0
+			}
+			reply <- err
+			continue
+		}
+
+		if time.Now().Before(retryAt) {
+			// 退避期间的记录先落盘，保持顺序
+			if s.cfg.SpoolFile != "" && len(buf) >= s.cfg.BatchSize {
+				s.spool(&buf)
+			}
+			continue
+		}
+		if len(buf) == 0 && !s.spooled() {
+			continue
+		}
+		err := s.ship(&buf)
+		if err != nil {
+			backoff = min(max(backoff*2, minBackoff), s.cfg.MaxBackoff)
+			retryAt = time.Now().Add(backoff)
+			fmt.Fprintf(os.Stderr, "failed to send logs, retrying in %v: %v\n", backoff, err)
+			if s.cfg.SpoolFile != "" {
+				s.spool(&buf)
+			}
+			continue
+		}
+		retryAt, backoff = time.Time{}, 0
+	}
+}
+
+// 不阻塞地取出队列中的所有记录
+func (s *Shipper) drainQueue(buf []Record) []Record {
+	for {
+		select {
+		case rec := <-s.queue:
+			buf = append(buf, rec)
+		default:
+			return buf
+		}
+	}
+}
+
+// 先补发 spool 文件中的记录，再分批发送 buf；发送成功的记录从 buf 中移除
+func (s *Shipper) ship(buf *[]Record) error {
+	err := s.shipSpool()
+	if err != nil {
+		return err
+	}
+	for len(*buf) > 0 {
+		n := min(len(*buf), s.cfg.BatchSize)
+		err := s.send((*buf)[:n])
+		if err != nil {
+			return err
+		}
+		*buf = (*buf)[n:]
+	}
+	*buf = nil
+	return nil
+}
+
+// 发送一批记录
+func (s *Shipper) send(batch []Record) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	// 换实例重发最多导致重复的日志，比丢失好
+	ctx = registry.WithRetry(ctx)
+	res, err := s.client.Post(ctx, registry.LogService, "/log/batch", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("log service responded with code %v", res.StatusCode)
+	}
+	return nil
+}
+
+// 发送失败的记录：保存到 spool 文件，没有 spool 文件或者保存失败时写到标准错误输出
+func (s *Shipper) saveUnsent(buf []Record) {
+	if s.cfg.SpoolFile != "" {
+		s.spool(&buf)
+	}
+	for _, rec := range buf {
+		writeStderr(rec)
+	}
+}
+
+// spool 文件中是否有记录
+func (s *Shipper) spooled() bool {
+	if s.cfg.SpoolFile == "" {
+		return false
+	}
+	info, err := os.Stat(s.cfg.SpoolFile)
+	return err == nil && info.Size() > 0
+}
+
+// 把 buf 追加到 spool 文件，成功后清空 buf
+func (s *Shipper) spool(buf *[]Record) {
+	if len(*buf) == 0 {
+		return
+	}
+	var data bytes.Buffer
+	for _, rec := range *buf {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			continue
+		}
+		data.Write(line)
+		data.WriteByte('\n')
+	}
+	f, err := os.OpenFile(s.cfg.SpoolFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	_, err = f.Write(data.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	*buf = nil
+}
+
+// 分批补发 spool 文件中的记录。中途失败时把没有发出去的记录写回 spool 文件
+func (s *Shipper) shipSpool() error {
+	if !s.spooled() {
+		return nil
+	}
+	f, err := os.Open(s.cfg.SpoolFile)
+	if err != nil {
+		return err
+	}
+	var recs []Record
+	err = readRecords(f, func(rec Record) bool {
+		recs = append(recs, rec)
+		return true
+	})
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	for sent := 0; sent < len(recs); {
+		n := min(len(recs)-sent, s.cfg.BatchSize)
+		err = s.send(recs[sent : sent+n])
+		if err != nil {
+			if sent > 0 {
+				if rerr := s.rewriteSpool(recs[sent:]); rerr != nil {
+					fmt.Fprintln(os.Stderr, rerr)
+				}
+			}
+			return err
+		}
+		sent += n
+	}
+	return os.Remove(s.cfg.SpoolFile)
+}
+
+// 用 recs 替换 spool 文件的内容：先写临时文件再重命名
+func (s *Shipper) rewriteSpool(recs []Record) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.cfg.SpoolFile), filepath.Base(s.cfg.SpoolFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	enc := json.NewEncoder(tmp)
+	for _, rec := range recs {
+		if err = enc.Encode(rec); err != nil {
+			break
+		}
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.cfg.SpoolFile)
+}
@@ -0,0 +1,180 @@
+package log
+
+import (
+	"context"
+	"distributed/registry"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 假的日志服务：前 failures 个 /log/batch 请求返回 500，之后按顺序记录收到的消息
+type fakeLogService struct {
+	failures int32
+	hits     atomic.Int32
+	onAccept func() // 第一次接受请求时调用
+
+	mutex   sync.Mutex
+	records []Record
+}
+
+func (f *fakeLogService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := f.hits.Add(1)
+	if n <= f.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n == f.failures+1 && f.onAccept != nil {
+		f.onAccept()
+	}
+	var recs []Record
+	if err := json.NewDecoder(r.Body).Decode(&recs); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.records = append(f.records, recs...)
+}
+
+func (f *fakeLogService) received() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	messages := make([]string, 0, len(f.records))
+	for _, rec := range f.records {
+		messages = append(messages, rec.Message)
+	}
+	return messages
+}
+
+func (f *fakeLogService) receivedRecords() []Record {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]Record(nil), f.records...)
+}
+
+// 在内存中的注册中心注册 fake 为 LogService，并通过 Watch 让本进程发现它
+func serveLogService(t *testing.T, fake *fakeLogService) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle("/log/batch", fake)
+	logSrv := httptest.NewServer(mux)
+	t.Cleanup(logSrv.Close)
+
+	rs := registry.NewRegistryServiceWithStorage(registry.NewMemoryStorage())
+	regMux := http.NewServeMux()
+	rs.RegisterHandlers(regMux)
+	regSrv := httptest.NewServer(regMux)
+	t.Cleanup(regSrv.Close)
+	t.Cleanup(rs.Stop)
+
+	registryURL := regSrv.URL + "/services"
+	reg := registry.Registration{ServiceName: registry.LogService, ServiceID: "shipper-test-log", ServiceURL: logSrv.URL}
+	if err := registry.RegisterService(http.NewServeMux(), registryURL, reg); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		registry.Watch(ctx, registryURL, registry.LogService)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := registry.GetProviders(registry.LogService); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("log service was not discovered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShipperRetriesAndReplaysSpoolInOrder(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "spool.jsonl")
+	var spooled atomic.Bool
+	fake := &fakeLogService{failures: 3}
+	// 日志服务恢复时，发送失败的记录已经保存在 spool 文件中
+	fake.onAccept = func() {
+		if info, err := os.Stat(spool); err == nil && info.Size() > 0 {
+			spooled.Store(true)
+		}
+	}
+	serveLogService(t, fake)
+
+	// 每次只发送一次，失败由 Shipper 退避重试；失败次数低于熔断阈值
+	client := registry.NewClient()
+	client.MaxAttempts = 1
+	s := NewShipper(client, ShipperConfig{
+		QueueSize:     10,
+		BatchSize:     5,
+		FlushInterval: 10 * time.Millisecond,
+		MaxBackoff:    20 * time.Millisecond,
+		SpoolFile:     spool,
+	})
+	defer s.Close(context.Background())
+
+	var want []string
+	for i := 0; i < 50; i++ {
+		msg := fmt.Sprintf("line %d", i)
+		want = append(want, msg)
+		s.Enqueue(Record{Message: msg})
+		// 队列很小：让后台把记录取出，发送失败期间写入 spool 文件
+		time.Sleep(time.Millisecond)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(fake.received()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := fake.received()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("received %v, want %v", got, want)
+	}
+	if s.Spilled() != 0 {
+		t.Errorf("%d records spilled to stderr", s.Spilled())
+	}
+	if fake.hits.Load() <= fake.failures {
+		t.Errorf("log service received %d requests, want more than %d", fake.hits.Load(), fake.failures)
+	}
+	if !spooled.Load() {
+		t.Error("unsent records were not spooled while the log service was failing")
+	}
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Errorf("spool file left behind after replay: %v", err)
+	}
+}
+
+func TestShipperCloseFlushesQueue(t *testing.T) {
+	fake := &fakeLogService{}
+	serveLogService(t, fake)
+
+	// 不够一批、也没到发送间隔的记录在关闭时发送
+	s := NewShipper(registry.NewClient(), ShipperConfig{BatchSize: 100, FlushInterval: time.Hour})
+	var want []string
+	for i := 0; i < 5; i++ {
+		msg := fmt.Sprintf("flush %d", i)
+		want = append(want, msg)
+		s.Enqueue(Record{Message: msg})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.received(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("received %v, want %v", got, want)
+	}
+}
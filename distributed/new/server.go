@@ -8,8 +8,8 @@ import (
 	"net/http"
 )
 
-func RegisterHandlers() {
-	http.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+func RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
 			// 记录日志消息到日志服务
@@ -35,25 +35,14 @@ func WritetoLog(w http.ResponseWriter, r *http.Request) {
 	msg := requestData.Msg
 	fmt.Println("msg:", msg)
 
-	// 通过服务发现 得到日志服务地址
-	url, err := registry.GetProvider(registry.LogService)
-	fmt.Println("url:", url)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	if url == "" {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// 向日志服务发送http post请求信息
+	// 按服务名向日志服务发送http post请求信息，由客户端完成服务发现和失败重试
 	body := bytes.NewBufferString(msg)
-	_, err = http.Post(url+"/log", "text/plain", body)
+	res, err := registry.DefaultClient.Post(r.Context(), registry.LogService, "/log", "text/plain", body)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	res.Body.Close()
 
 	w.WriteHeader(http.StatusOK)
 }
\ No newline at end of file
@@ -4,20 +4,26 @@ package portal
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 	"distributed/grades"
 	"distributed/registry"
 )
-func RegisterHandlers() {
-	http.Handle("/", http.RedirectHandler("/students", http.StatusPermanentRedirect))
+
+// 访问 GradingService 的超时时间（包括换实例重试）
+const requestTimeout = 5 * time.Second
+
+func RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("/", http.RedirectHandler("/students", http.StatusPermanentRedirect))
 	h := new(studentsHandler)
-	http.Handle("/students", h)
-	http.Handle("/students/", h)
+	mux.Handle("/students", h)
+	mux.Handle("/students/", h)
 }
 type studentsHandler struct{}
 var _ http.Handler = (*studentsHandler)(nil)
@@ -48,7 +54,7 @@ func (sh studentsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 	}
 }
-func (studentsHandler) renderStudents(w http.ResponseWriter, _ *http.Request) {
+func (studentsHandler) renderStudents(w http.ResponseWriter, r *http.Request) {
 	var err error
 	defer func() {
 		if err != nil {
@@ -56,16 +62,14 @@ func (studentsHandler) renderStudents(w http.ResponseWriter, _ *http.Request) {
 			log.Println("Error retrieving students: ", err)
 		}
 	}()
-	// 从注册中心获得依赖的服务url
-	serviceURL, err := registry.GetProvider(registry.GradingService)
-	if err != nil {
-		return
-	}
-	// 通过向服务的url请求得到数据
-	res, err := http.Get(serviceURL + "/students")
+	// 按服务名请求数据，实例不可用时客户端会换一个实例重试
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	res, err := registry.DefaultClient.Get(ctx, registry.GradingService, "/students")
 	if err != nil {
 		return
 	}
+	defer res.Body.Close()
 	// 整合并发送数据到模板
 	var s grades.Students
 	err = json.NewDecoder(res.Body).Decode(&s)
@@ -74,7 +78,7 @@ func (studentsHandler) renderStudents(w http.ResponseWriter, _ *http.Request) {
 	}
 	rootTemplate.Lookup("students.html").Execute(w, s)
 }
-func (studentsHandler) renderStudent(w http.ResponseWriter, _ *http.Request, id int) {
+func (studentsHandler) renderStudent(w http.ResponseWriter, r *http.Request, id int) {
 	var err error
 	defer func() {
 		if err != nil {
@@ -83,14 +87,14 @@ func (studentsHandler) renderStudent(w http.ResponseWriter, _ *http.Request, id
 			return
 		}
 	}()
-	serviceURL, err := registry.GetProvider(registry.GradingService)
-	if err != nil {
-		return
-	}
-	res, err := http.Get(fmt.Sprintf("%v/students/%v", serviceURL, id))
+	// 按学生ID选择实例，同一个学生的请求固定落到同一个 GradingService 实例上
+	ctx, cancel := context.WithTimeout(registry.WithBalanceKey(r.Context(), strconv.Itoa(id)), requestTimeout)
+	defer cancel()
+	res, err := registry.DefaultClient.Get(ctx, registry.GradingService, fmt.Sprintf("/students/%v", id))
 	if err != nil {
 		return
 	}
+	defer res.Body.Close()
 	var s grades.Student
 	err = json.NewDecoder(res.Body).Decode(&s)
 	if err != nil {
@@ -123,16 +127,14 @@ func (studentsHandler) renderGrades(w http.ResponseWriter, r *http.Request, id i
 	if err != nil {
 		log.Println("Failed to convert grade to JSON: ", g, err)
 	}
-	serviceURL, err := registry.GetProvider(registry.GradingService)
-	if err != nil {
-		log.Println("Failed to retrieve instance of Grading Service", err)
-		return
-	}
-	res, err := http.Post(fmt.Sprintf("%v/students/%v/grades", serviceURL, id), "application/json", bytes.NewBuffer(data))
+	ctx, cancel := context.WithTimeout(registry.WithBalanceKey(r.Context(), strconv.Itoa(id)), requestTimeout)
+	defer cancel()
+	res, err := registry.DefaultClient.Post(ctx, registry.GradingService, fmt.Sprintf("/students/%v/grades", id), "application/json", bytes.NewBuffer(data))
 	if err != nil {
 		log.Println("Failed to save grade to Grading Service", err)
 		return
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusCreated {
 		log.Println("Failed to save grade to Grading Service. Status: ", res.StatusCode)
 		return
@@ -1,15 +1,21 @@
 package portal
 import (
+	"embed"
 	"html/template"
 )
+
+// 模板文件编译进程序，不依赖运行时的工作目录
+//go:embed students.html student.html
+var templateFS embed.FS
+
 var rootTemplate *template.Template
 func ImportTemplates() error {
 	var err error
-	rootTemplate, err = template.ParseFiles(
-		"../../portal/students.html",
-		"../../portal/student.html")
+	rootTemplate, err = template.ParseFS(templateFS,
+		"students.html",
+		"student.html")
 	if err != nil {
 		return err
 	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,195 @@
+package registry
+
+// 客户端负载均衡：从依赖服务的多个实例中选出一个，每个依赖服务可以使用不同的策略
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 负载均衡策略
+type Balancer interface {
+	// 从可用实例中选出一个；key 由调用方提供，只有一致性哈希会用到
+	Pick(instances []Instance, key string) (Instance, error)
+}
+
+// 需要知道请求何时结束的策略（如最少未完成请求）额外实现该接口
+type RequestTracker interface {
+	Balancer
+	Done(instance Instance)
+}
+
+var errNoInstances = errors.New("no instances to pick from")
+
+// 随机：默认策略
+type randomBalancer struct{}
+
+func (randomBalancer) Pick(instances []Instance, _ string) (Instance, error) {
+	if len(instances) == 0 {
+		return Instance{}, errNoInstances
+	}
+	return instances[rand.Intn(len(instances))], nil
+}
+
+// 轮询
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+func NewRoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+func (b *roundRobin) Pick(instances []Instance, _ string) (Instance, error) {
+	if len(instances) == 0 {
+		return Instance{}, errNoInstances
+	}
+	n := b.next.Add(1) - 1
+	return instances[n%uint64(len(instances))], nil
+}
+
+// 最少未完成请求：选择当前正在处理请求最少的实例，调用方在请求结束后需要调用 Done
+type leastOutstanding struct {
+	mutex       sync.Mutex
+	outstanding map[string]int // 实例ID -> 未完成的请求数
+}
+
+func NewLeastOutstanding() RequestTracker {
+	return &leastOutstanding{outstanding: make(map[string]int)}
+}
+
+func (b *leastOutstanding) Pick(instances []Instance, _ string) (Instance, error) {
+	if len(instances) == 0 {
+		return Instance{}, errNoInstances
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// 从随机位置开始比较，避免请求数相同时总是选中第一个实例
+	start := rand.Intn(len(instances))
+	best := instances[start]
+	for i := 1; i < len(instances); i++ {
+		inst := instances[(start+i)%len(instances)]
+		if b.outstanding[inst.ID] < b.outstanding[best.ID] {
+			best = inst
+		}
+	}
+	b.outstanding[best.ID]++
+	return best, nil
+}
+
+func (b *leastOutstanding) Done(instance Instance) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.outstanding[instance.ID] <= 1 {
+		delete(b.outstanding, instance.ID)
+		return
+	}
+	b.outstanding[instance.ID]--
+}
+
+// 加权随机：被选中的概率与 Registration.Weight 成正比，未设置权重按 1 计算
+type weighted struct{}
+
+func NewWeighted() Balancer {
+	return weighted{}
+}
+
+func weightOf(instance Instance) int {
+	if instance.Weight <= 0 {
+		return 1
+	}
+	return instance.Weight
+}
+
+func (weighted) Pick(instances []Instance, _ string) (Instance, error) {
+	if len(instances) == 0 {
+		return Instance{}, errNoInstances
+	}
+	total := 0
+	for _, inst := range instances {
+		total += weightOf(inst)
+	}
+	n := rand.Intn(total)
+	for _, inst := range instances {
+		n -= weightOf(inst)
+		if n < 0 {
+			return inst, nil
+		}
+	}
+	return instances[len(instances)-1], nil
+}
+
+// 一致性哈希：相同的 key 总是落到同一个实例上，实例增减时只有少部分 key 会迁移。
+// key 为空时退化为随机选择。
+type consistentHash struct {
+	replicas int // 每个实例在哈希环上的虚拟节点数
+
+	mutex     sync.Mutex
+	signature string // 构建哈希环时的实例集合，实例变化时重建
+	ring      []uint32
+	nodes     map[uint32]Instance
+}
+
+// 默认的虚拟节点数
+const DefaultHashReplicas = 100
+
+// replicas 为每个实例的虚拟节点数，<=0 时使用 DefaultHashReplicas
+func NewConsistentHash(replicas int) Balancer {
+	if replicas <= 0 {
+		replicas = DefaultHashReplicas
+	}
+	return &consistentHash{replicas: replicas}
+}
+
+func (b *consistentHash) Pick(instances []Instance, key string) (Instance, error) {
+	if len(instances) == 0 {
+		return Instance{}, errNoInstances
+	}
+	if key == "" {
+		return randomBalancer{}.Pick(instances, key)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.build(instances)
+	h := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= h })
+	if idx == len(b.ring) {
+		idx = 0
+	}
+	return b.nodes[b.ring[idx]], nil
+}
+
+// 实例集合变化时重建哈希环；调用方需持有锁
+func (b *consistentHash) build(instances []Instance) {
+	ids := make([]string, 0, len(instances))
+	for _, inst := range instances {
+		ids = append(ids, inst.ID+"@"+inst.URL)
+	}
+	sort.Strings(ids)
+	signature := strings.Join(ids, ",")
+	if signature == b.signature {
+		return
+	}
+
+	b.signature = signature
+	b.ring = make([]uint32, 0, len(instances)*b.replicas)
+	b.nodes = make(map[uint32]Instance, len(instances)*b.replicas)
+	for _, inst := range instances {
+		for i := 0; i < b.replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", inst.ID, i)))
+			b.ring = append(b.ring, h)
+			b.nodes[h] = inst
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i] < b.ring[j] })
+}
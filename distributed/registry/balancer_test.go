@@ -0,0 +1,232 @@
+package registry
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func balancerInstances(ids ...string) []Instance {
+	instances := make([]Instance, 0, len(ids))
+	for _, id := range ids {
+		instances = append(instances, Instance{ID: id, Name: "Balanced", URL: "http://" + id})
+	}
+	return instances
+}
+
+func TestBalancersWithoutInstances(t *testing.T) {
+	for name, b := range map[string]Balancer{
+		"random":            randomBalancer{},
+		"round robin":       NewRoundRobin(),
+		"least outstanding": NewLeastOutstanding(),
+		"weighted":          NewWeighted(),
+		"consistent hash":   NewConsistentHash(0),
+	} {
+		if _, err := b.Pick(nil, "key"); err != errNoInstances {
+			t.Errorf("%s: Pick with no instances returned %v", name, err)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances []string
+		picks     int
+		want      []string
+	}{
+		{"single instance", []string{"a"}, 3, []string{"a", "a", "a"}},
+		{"wraps around", []string{"a", "b", "c"}, 7, []string{"a", "b", "c", "a", "b", "c", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewRoundRobin()
+			instances := balancerInstances(tt.instances...)
+			for i := 0; i < tt.picks; i++ {
+				inst, err := b.Pick(instances, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if inst.ID != tt.want[i] {
+					t.Errorf("pick %d = %s, want %s", i, inst.ID, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	// 每一步选择一个实例（done 为空）或者结束一个请求，然后检查各实例未完成的请求数；
+	// want 为空表示有多个实例请求数相同，选中哪一个都可以
+	type step struct {
+		done        string
+		want        string
+		outstanding map[string]int
+	}
+	tests := []struct {
+		name      string
+		instances []string
+		steps     []step
+	}{
+		{
+			name:      "spreads picks across idle instances",
+			instances: []string{"a", "b", "c"},
+			steps: []step{
+				{},
+				{},
+				{outstanding: map[string]int{"a": 1, "b": 1, "c": 1}},
+				{},
+				{},
+				{outstanding: map[string]int{"a": 2, "b": 2, "c": 2}},
+			},
+		},
+		{
+			name:      "picks the instance that finished a request",
+			instances: []string{"a", "b"},
+			steps: []step{
+				{},
+				{outstanding: map[string]int{"a": 1, "b": 1}},
+				{done: "b", outstanding: map[string]int{"a": 1}},
+				{want: "b", outstanding: map[string]int{"a": 1, "b": 1}},
+				{done: "a"},
+				{done: "b", outstanding: map[string]int{}},
+			},
+		},
+		{
+			name:      "Done of an unknown instance is ignored",
+			instances: []string{"a"},
+			steps: []step{
+				{done: "x", outstanding: map[string]int{}},
+				{want: "a", outstanding: map[string]int{"a": 1}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewLeastOutstanding()
+			instances := balancerInstances(tt.instances...)
+			for i, s := range tt.steps {
+				if s.done != "" {
+					b.Done(Instance{ID: s.done})
+				} else {
+					inst, err := b.Pick(instances, "")
+					if err != nil {
+						t.Fatal(err)
+					}
+					if s.want != "" && inst.ID != s.want {
+						t.Errorf("step %d picked %s, want %s", i, inst.ID, s.want)
+					}
+				}
+				if s.outstanding == nil {
+					continue
+				}
+				got := b.(*leastOutstanding).outstanding
+				if len(got) != len(s.outstanding) {
+					t.Errorf("step %d: outstanding %v, want %v", i, got, s.outstanding)
+					continue
+				}
+				for id, n := range s.outstanding {
+					if got[id] != n {
+						t.Errorf("step %d: outstanding %v, want %v", i, got, s.outstanding)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		want    map[string]float64 // 期望的选中比例
+	}{
+		{"equal weights", map[string]int{"a": 1, "b": 1}, map[string]float64{"a": 0.5, "b": 0.5}},
+		{"proportional", map[string]int{"a": 1, "b": 3}, map[string]float64{"a": 0.25, "b": 0.75}},
+		{"unset weight counts as one", map[string]int{"a": 0, "b": 2, "c": -1}, map[string]float64{"a": 0.25, "b": 0.5, "c": 0.25}},
+	}
+	const picks = 40000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var instances []Instance
+			for id, w := range tt.weights {
+				instances = append(instances, Instance{ID: id, Weight: w})
+			}
+			counts := make(map[string]int)
+			b := NewWeighted()
+			for i := 0; i < picks; i++ {
+				inst, err := b.Pick(instances, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				counts[inst.ID]++
+			}
+			for id, want := range tt.want {
+				got := float64(counts[id]) / picks
+				if math.Abs(got-want) > 0.02 {
+					t.Errorf("%s picked %.3f of the time, want %.3f", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("student-%d", i)
+	}
+	assign := func(b Balancer, instances []Instance) map[string]string {
+		t.Helper()
+		m := make(map[string]string, len(keys))
+		for _, key := range keys {
+			inst, err := b.Pick(instances, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m[key] = inst.ID
+		}
+		return m
+	}
+
+	b := NewConsistentHash(0)
+	before := assign(b, balancerInstances("a", "b", "c"))
+	// 实例集合不变（顺序不同）时结果不变
+	if again := assign(b, balancerInstances("c", "a", "b")); fmt.Sprint(again) != fmt.Sprint(before) {
+		t.Fatal("same instances assigned keys differently")
+	}
+
+	tests := []struct {
+		name      string
+		instances []string
+		// 允许迁移的 key：原来在哪些实例上，迁移到哪些实例上
+		movedFrom map[string]bool
+		movedTo   map[string]bool
+		maxMoved  float64
+	}{
+		{"instance added", []string{"a", "b", "c", "d"}, nil, map[string]bool{"d": true}, 0.4},
+		{"instance removed", []string{"a", "c"}, map[string]bool{"b": true}, nil, 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			after := assign(NewConsistentHash(0), balancerInstances(tt.instances...))
+			moved := 0
+			for _, key := range keys {
+				if after[key] == before[key] {
+					continue
+				}
+				moved++
+				if tt.movedFrom != nil && !tt.movedFrom[before[key]] {
+					t.Errorf("%s moved from %s to %s", key, before[key], after[key])
+				}
+				if tt.movedTo != nil && !tt.movedTo[after[key]] {
+					t.Errorf("%s moved from %s to %s", key, before[key], after[key])
+				}
+			}
+			if moved == 0 || float64(moved)/float64(len(keys)) > tt.maxMoved {
+				t.Errorf("%d of %d keys moved", moved, len(keys))
+			}
+		})
+	}
+}
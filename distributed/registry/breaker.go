@@ -0,0 +1,197 @@
+package registry
+
+// 熔断器：按实例地址统计请求失败次数，连续失败达到阈值后打开熔断，
+// 熔断中的实例不再参与负载均衡；经过一段时间后进入半开状态，只放行一个试探请求，
+// 试探成功则关闭熔断，失败则重新打开
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   = BreakerState("closed")    // 正常
+	BreakerOpen     = BreakerState("open")      // 熔断中，不参与选择
+	BreakerHalfOpen = BreakerState("half-open") // 试探中
+)
+
+// 熔断器配置
+type BreakerConfig struct {
+	FailureThreshold int           // 连续失败多少次后打开熔断
+	OpenTimeout      time.Duration // 打开多久之后进入半开状态进行试探
+}
+
+// 熔断器配置的默认值
+const (
+	DefaultBreakerFailureThreshold = 5
+	DefaultBreakerOpenTimeout      = 10 * time.Second
+)
+
+// 一个实例的熔断状态
+type BreakerStatus struct {
+	URL      string
+	State    BreakerState
+	Failures int       // 连续失败次数
+	OpenedAt time.Time // 最近一次打开熔断的时间
+}
+
+type breaker struct {
+	status      BreakerStatus
+	probing     bool      // 半开状态下是否已经放行了试探请求
+	probeSentAt time.Time // 试探请求的放行时间，试探没有结果时超时后允许再次试探
+}
+
+type breakers struct {
+	mutex  sync.Mutex
+	config BreakerConfig
+	byURL  map[string]*breaker
+	now    func() time.Time // 当前时间，测试中可以替换
+}
+
+var breakerSet = &breakers{
+	config: BreakerConfig{
+		FailureThreshold: DefaultBreakerFailureThreshold,
+		OpenTimeout:      DefaultBreakerOpenTimeout,
+	},
+	byURL: make(map[string]*breaker),
+	now:   time.Now,
+}
+
+// 设置熔断器配置，未设置（<=0）的字段使用默认值
+func SetBreakerConfig(config BreakerConfig) {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = DefaultBreakerFailureThreshold
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = DefaultBreakerOpenTimeout
+	}
+	breakerSet.mutex.Lock()
+	defer breakerSet.mutex.Unlock()
+	breakerSet.config = config
+}
+
+// 当前所有实例的熔断状态，按地址排序
+func BreakerStates() []BreakerStatus {
+	breakerSet.mutex.Lock()
+	defer breakerSet.mutex.Unlock()
+
+	states := make([]BreakerStatus, 0, len(breakerSet.byURL))
+	for _, b := range breakerSet.byURL {
+		states = append(states, b.status)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].URL < states[j].URL })
+	return states
+}
+
+// 以 JSON 返回熔断状态，便于查看哪些实例被熔断
+func BreakerHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(BreakerStates())
+		if err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// 是否允许向该实例发送请求：关闭状态直接放行；打开状态超时后转为半开并放行一个试探请求
+func (bs *breakers) acquire(url string) bool {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	b, ok := bs.byURL[url]
+	if !ok {
+		return true
+	}
+	now := bs.now()
+	switch b.status.State {
+	case BreakerOpen:
+		if now.Sub(b.status.OpenedAt) < bs.config.OpenTimeout {
+			return false
+		}
+		b.status.State = BreakerHalfOpen
+	case BreakerHalfOpen:
+		if b.probing && now.Sub(b.probeSentAt) < bs.config.OpenTimeout {
+			return false
+		}
+	default:
+		return true
+	}
+	b.probing = true
+	b.probeSentAt = now
+	return true
+}
+
+// 是否可以选择该实例，不改变熔断状态：用于只返回地址、不上报请求结果的 GetProvider 等函数。
+// 打开状态超时后、半开状态没有正在进行的试探时可以选择，但不占用试探机会
+func (bs *breakers) available(url string) bool {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	b, ok := bs.byURL[url]
+	if !ok {
+		return true
+	}
+	now := bs.now()
+	switch b.status.State {
+	case BreakerOpen:
+		return now.Sub(b.status.OpenedAt) >= bs.config.OpenTimeout
+	case BreakerHalfOpen:
+		return !b.probing || now.Sub(b.probeSentAt) >= bs.config.OpenTimeout
+	default:
+		return true
+	}
+}
+
+// 请求成功：关闭熔断。
+// 状态变化不在这里输出日志：日志客户端本身也通过 Client 发送，在标准库 logger 的锁内再次写日志会死锁，
+// 需要查看时通过 BreakerStates 获取。
+func (bs *breakers) success(url string) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	b, ok := bs.byURL[url]
+	if !ok {
+		return
+	}
+	b.status.State = BreakerClosed
+	b.status.Failures = 0
+	b.probing = false
+}
+
+// 请求失败：连续失败达到阈值或者试探失败时打开熔断
+func (bs *breakers) failure(url string) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	b, ok := bs.byURL[url]
+	if !ok {
+		b = &breaker{status: BreakerStatus{URL: url, State: BreakerClosed}}
+		bs.byURL[url] = b
+	}
+	b.status.Failures++
+	trip := b.status.State == BreakerHalfOpen ||
+		(b.status.State == BreakerClosed && b.status.Failures >= bs.config.FailureThreshold)
+	if trip {
+		b.status.State = BreakerOpen
+		b.status.OpenedAt = bs.now()
+		b.probing = false
+	}
+}
+
+// 实例被移除后丢弃它的熔断状态，同一地址重新注册时从关闭状态开始
+func (bs *breakers) forget(url string) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	delete(bs.byURL, url)
+}
@@ -0,0 +1,133 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	const url = "http://breaker"
+	const timeout = 10 * time.Second
+	type step struct {
+		op        string        // failure、success、acquire、available
+		advance   time.Duration // 执行之前时钟前进多少
+		allowed   bool          // acquire、available 的结果
+		wantState BreakerState  // 执行之后的状态，空表示没有记录
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"closed below threshold", []step{
+			{op: "failure", wantState: BreakerClosed},
+			{op: "failure", wantState: BreakerClosed},
+			{op: "acquire", allowed: true, wantState: BreakerClosed},
+		}},
+		{"success resets failures", []step{
+			{op: "failure"}, {op: "failure"},
+			{op: "success", wantState: BreakerClosed},
+			{op: "failure"}, {op: "failure", wantState: BreakerClosed},
+		}},
+		{"opens at threshold", []step{
+			{op: "failure"}, {op: "failure"},
+			{op: "failure", wantState: BreakerOpen},
+			{op: "acquire", allowed: false, wantState: BreakerOpen},
+			{op: "available", advance: timeout - time.Millisecond, allowed: false, wantState: BreakerOpen},
+		}},
+		{"half-open probe closes", []step{
+			{op: "failure"}, {op: "failure"}, {op: "failure"},
+			// 只返回地址不占用试探机会
+			{op: "available", advance: timeout, allowed: true, wantState: BreakerOpen},
+			{op: "acquire", allowed: true, wantState: BreakerHalfOpen},
+			{op: "acquire", allowed: false, wantState: BreakerHalfOpen},
+			{op: "available", allowed: false, wantState: BreakerHalfOpen},
+			{op: "success", wantState: BreakerClosed},
+			{op: "acquire", allowed: true, wantState: BreakerClosed},
+		}},
+		{"half-open probe failure reopens", []step{
+			{op: "failure"}, {op: "failure"}, {op: "failure"},
+			{op: "acquire", advance: timeout, allowed: true, wantState: BreakerHalfOpen},
+			{op: "failure", wantState: BreakerOpen},
+			{op: "acquire", allowed: false, wantState: BreakerOpen},
+			{op: "acquire", advance: timeout, allowed: true, wantState: BreakerHalfOpen},
+		}},
+		{"lost probe is retried after timeout", []step{
+			{op: "failure"}, {op: "failure"}, {op: "failure"},
+			{op: "acquire", advance: timeout, allowed: true, wantState: BreakerHalfOpen},
+			{op: "acquire", advance: timeout, allowed: true, wantState: BreakerHalfOpen},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1000, 0)
+			bs := &breakers{
+				config: BreakerConfig{FailureThreshold: 3, OpenTimeout: timeout},
+				byURL:  make(map[string]*breaker),
+				now:    func() time.Time { return now },
+			}
+			for i, s := range tt.steps {
+				now = now.Add(s.advance)
+				switch s.op {
+				case "failure":
+					bs.failure(url)
+				case "success":
+					bs.success(url)
+				case "acquire":
+					if got := bs.acquire(url); got != s.allowed {
+						t.Fatalf("step %d: acquire = %v, want %v", i, got, s.allowed)
+					}
+				case "available":
+					if got := bs.available(url); got != s.allowed {
+						t.Fatalf("step %d: available = %v, want %v", i, got, s.allowed)
+					}
+				}
+				if s.wantState != "" {
+					if got := bs.byURL[url].status.State; got != s.wantState {
+						t.Fatalf("step %d (%s): state %v, want %v", i, s.op, got, s.wantState)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerHandler(t *testing.T) {
+	const url = "http://breaker-handler"
+	SetBreakerConfig(BreakerConfig{FailureThreshold: 1})
+	t.Cleanup(func() {
+		SetBreakerConfig(BreakerConfig{})
+		breakerSet.forget(url)
+	})
+	breakerSet.failure(url)
+
+	rec := httptest.NewRecorder()
+	BreakerHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/breakers", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("handler responded with code %v and content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var states []BreakerStatus
+	if err := json.NewDecoder(rec.Body).Decode(&states); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, st := range states {
+		if st.URL == url {
+			found = true
+			if st.State != BreakerOpen || st.Failures != 1 || st.OpenedAt.IsZero() {
+				t.Errorf("handler reported %+v", st)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("%s missing from %+v", url, states)
+	}
+
+	rec = httptest.NewRecorder()
+	BreakerHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/breakers", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST responded with code %v", rec.Code)
+	}
+}
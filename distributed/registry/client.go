@@ -4,50 +4,108 @@ package registry
 // 内部发送http请求，用于进行服务注册
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
-// 向 registryservice 发送请求 注册服务
-func RegisterService(r Registration) error {
+// 访问注册中心的超时时间（包括读取响应）：节点没有响应时，超时后尝试下一个节点
+const DefaultRegistryTimeout = 10 * time.Second
 
-	// 这里作为接收者，处理http请求：为了确保服务在注册时能够立即验证其健康状态，并且确保服务在运行期间能够持续监控其健康状态。
-	// 心跳检查
-	heartbeatURL, err := url.Parse(r.HeartbeatURL)
-	if err != nil {
-		return err
+var (
+	registryClient = &http.Client{Timeout: DefaultRegistryTimeout}
+	// 长轮询最多等待 DefaultWatchTimeout，再加上正常请求的超时时间
+	watchClient = &http.Client{Timeout: DefaultWatchTimeout + DefaultRegistryTimeout}
+)
+
+// 注册中心以集群方式部署时，registryURL 可以是逗号分隔的多个节点地址，
+// 如 "http://localhost:3001/services,http://localhost:3002/services"。
+// 请求依次发送给各个节点，直到有节点处理：节点不可达、超时或返回 503（还没有选出主节点）时尝试下一个，
+// 跟随者返回的 307 重定向（写请求转给主节点）由 http.Client 自动跟随。
+func doRegistryRequest(client *http.Client, registryURL string, newRequest func(u string) (*http.Request, error)) (*http.Response, error) {
+	var lastErr error
+	for _, u := range strings.Split(registryURL, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		req, err := newRequest(u)
+		if err != nil {
+			return nil, err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if res.StatusCode == http.StatusServiceUnavailable {
+			res.Body.Close()
+			lastErr = fmt.Errorf("registry node %v is unavailable", u)
+			continue
+		}
+		return res, nil
 	}
-	http.HandleFunc(heartbeatURL.Path, func(writer http.ResponseWriter, request *http.Request) {
-		writer.WriteHeader(http.StatusOK)
-	})
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no registry address in %q", registryURL)
+	}
+	return nil, lastErr
+}
 
+// 向 registryservice 发送请求 注册服务，registryURL 为注册中心的访问地址（如 DefaultServicesURL）。
+// 接收补丁的处理程序挂载到 mux 上（每个服务使用自己的 mux，同一进程中可以运行多个服务）
+func RegisterService(mux *http.ServeMux, registryURL string, r Registration) error {
+
+	// 这里作为接收者，处理http请求：心跳检查的处理程序由 service 包根据服务注册的健康检查提供
 	// 服务更新
-	serviceUpdateURL, err := url.Parse(r.ServiceUpdateURL)
-	if err != nil {
-		return err
+	// 没有更新地址的服务（例如在 NAT 之后）不接收推送，改用 Watch 关注依赖服务的变化
+	if r.ServiceUpdateURL != "" {
+		serviceUpdateURL, err := url.Parse(r.ServiceUpdateURL)
+		if err != nil {
+			return err
+		}
+		mux.Handle(serviceUpdateURL.Path, &serviceUpdateHandler{
+			registryURL: registryURL,
+			required:    r.RequiredServices,
+			view:        prov.newView(r.ServiceID),
+		})
 	}
-	http.Handle(serviceUpdateURL.Path, &serviceUpdateHandler{})
 
+	return postRegistration(registryURL, r)
+}
+
+// 把注册记录发送给注册中心
+func postRegistration(registryURL string, r Registration) error {
 	// 创建 JSON 编码器
 
 	// 创建一个新的缓冲区 buf ，缓冲区实现了io.Writer 和 io.Reader可以进行数据的读取和写入
 	buf := new(bytes.Buffer)
 	enc := json.NewEncoder(buf)
-	err = enc.Encode(r)
+	err := enc.Encode(r)
 	if err != nil {
 		return nil
 	}
 	
-	res, err := http.Post(ServicesURL,"application/json", buf)
+	res, err := doRegistryRequest(registryClient, registryURL, func(u string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "application/json")
+		return req, nil
+	})
 	// 请求过程中的错误：表示请求成功发送，但你仍然需要检查 res.StatusCode
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
 	// 处理过程中的错误
 	// 如果注册失败
@@ -59,16 +117,86 @@ func RegisterService(r Registration) error {
 	return nil
 }
 
-type serviceUpdateHandler struct {}
+// 向 registryservice 查询当前的注册记录：name 为空时返回所有服务，healthyOnly 只返回心跳检查通过的服务
+func LookupServices(registryURL string, name ServiceName, healthyOnly bool) ([]Registration, error) {
+	res, err := doRegistryRequest(registryClient, registryURL, func(addr string) (*http.Request, error) {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		if name != "" {
+			q.Set("name", string(name))
+		}
+		if healthyOnly {
+			q.Set("healthy", "true")
+		}
+		u.RawQuery = q.Encode()
+		return http.NewRequest(http.MethodGet, u.String(), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to lookup services. Registry service responded with code %v", res.StatusCode)
+	}
+	var regs []Registration
+	err = json.NewDecoder(res.Body).Decode(&regs)
+	if err != nil {
+		return nil, err
+	}
+	return regs, nil
+}
+
+// 查询纪元 epoch 中的版本 since 之后 names 中的服务发生的变化：GET {registryURL}?epoch=E&since=N&name=...。
+// 注册中心已经换了纪元，或者历史中没有 since 之后的全部变化时，返回 Full 为 true 的完整实例列表。
+func FetchChanges(registryURL string, epoch, since uint64, names ...ServiceName) (Patch, error) {
+	res, err := doRegistryRequest(registryClient, registryURL, func(addr string) (*http.Request, error) {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Set("epoch", strconv.FormatUint(epoch, 10))
+		q.Set("since", strconv.FormatUint(since, 10))
+		for _, name := range names {
+			q.Add("name", string(name))
+		}
+		u.RawQuery = q.Encode()
+		return http.NewRequest(http.MethodGet, u.String(), nil)
+	})
+	if err != nil {
+		return Patch{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return Patch{}, fmt.Errorf("failed to fetch changes. Registry service responded with code %v", res.StatusCode)
+	}
+	var p Patch
+	err = json.NewDecoder(res.Body).Decode(&p)
+	return p, err
+}
+
+// 接收注册中心推送的补丁，并按版本发现漏掉的补丁
+type serviceUpdateHandler struct {
+	registryURL string
+	required    []ServiceName // 依赖的服务，补齐时只查询这些服务的变化
+
+	mutex    sync.Mutex    // 补丁按顺序处理
+	epoch    uint64        // 已经同步到的纪元
+	revision uint64        // 在该纪元中已经同步到的版本
+	view     *providerView // 这个服务收到的实例
+}
 
 // 服务端有变化的时候，客户端接收更新
-func (suh serviceUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (suh *serviceUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 	dec := json.NewDecoder(r.Body)
-	var p patch
+	var p Patch
 	err := dec.Decode(&p)
 	if err != nil {
 		log.Println(err)
@@ -76,74 +204,435 @@ func (suh serviceUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 		return
 	}
 	fmt.Printf("Updated received: %v\n", p)
-	prov.Update(p)
+
+	suh.mutex.Lock()
+	defer suh.mutex.Unlock()
+	// 先比较纪元。纪元只是一个 ID，不能比较大小：注册中心换了主机重启、从单机切换到集群、集群重建后任期重新计数，
+	// 新的纪元都可能比之前的小。纪元不同时无法判断补丁是新是旧，以注册中心当前的完整列表为准
+	if p.Epoch != suh.epoch {
+		changes, err := FetchChanges(suh.registryURL, suh.epoch, suh.revision, suh.required...)
+		switch {
+		case err == nil:
+			log.Printf("Registry epoch changed from %d to %d, resynced", suh.epoch, changes.Epoch)
+			p = changes
+		case p.Full:
+			// 查询失败时仍然接受完整列表
+			log.Printf("Failed to resync providers for epoch %d: %v", p.Epoch, err)
+		default:
+			// 先应用收到的补丁，纪元和版本保持不变，下一个补丁到达时再次补齐
+			log.Printf("Failed to resync providers for epoch %d: %v", p.Epoch, err)
+			p.Epoch, p.Revision = suh.epoch, suh.revision
+		}
+	} else if p.Full {
+		// 完整列表与增量补丁并发发送，可能晚于更新的增量补丁到达：旧的完整列表会把缓存退回到之前的状态，丢弃
+		if p.Revision < suh.revision {
+			return
+		}
+	} else {
+		// 补齐时已经包含了这个补丁（补丁到达的顺序可能与发送顺序不同）
+		if p.Revision <= suh.revision {
+			return
+		}
+		// 上一个发给我们的补丁没有收到：向注册中心查询漏掉的变化
+		if p.Previous > suh.revision {
+			changes, err := FetchChanges(suh.registryURL, suh.epoch, suh.revision, suh.required...)
+			if err != nil {
+				// 先应用收到的补丁，纪元和版本保持不变，下一个补丁到达时再次补齐
+				log.Printf("Failed to resync providers from revision %d: %v", suh.revision, err)
+				p.Epoch, p.Revision = suh.epoch, suh.revision
+			} else {
+				log.Printf("Missed updates between revision %d and %d, resynced", suh.revision, p.Previous)
+				p = changes
+			}
+		}
+	}
+	suh.epoch, suh.revision = p.Epoch, p.Revision
+	prov.publish(prov.apply(suh.view, p))
 }
 
-// 向 registryservice 发送请求 取消服务
-func ShutdownService(url string) error {
+// 向 registryservice 发送请求 取消服务，serviceID 为注册时使用的实例ID
+func ShutdownService(registryURL, serviceID string) error {
 	// http包中没有delete方法: 对 服务注册 的 url 构建 delete 请求
-	req, err := http.NewRequest(http.MethodDelete,ServicesURL,bytes.NewBuffer([]byte(url)))
-	if err != nil {
-		return nil
-	}
-	req.Header.Add("Content-Type","text/plain")
-	res, err := http.DefaultClient.Do(req)
+	res, err := doRegistryRequest(registryClient, registryURL, func(u string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodDelete, u, bytes.NewBuffer([]byte(serviceID)))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "text/plain")
+		return req, nil
+	})
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 	// 如果取消失败
 	if res.StatusCode != http.StatusOK {
 		// 错误小写开头--惯例
 		return fmt.Errorf("failed to delete service. Delete service responded with code %v", res.StatusCode)
 	}
+	prov.release(serviceID)
 	return nil
 
 }
 
-//  提供依赖服务的集合
+// 续约：PUT {registryURL}/{serviceID}/lease，实例已不在注册中心时返回 ErrNotRegistered
+func RenewLease(registryURL, serviceID string) error {
+	res, err := doRegistryRequest(registryClient, registryURL, func(u string) (*http.Request, error) {
+		return http.NewRequest(http.MethodPut, u+"/"+url.PathEscape(serviceID)+"/lease", nil)
+	})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s", ErrNotRegistered, serviceID)
+	default:
+		return fmt.Errorf("failed to renew lease. Registry service responded with code %v", res.StatusCode)
+	}
+}
+
+// 租约模式下在后台定期续约，直到 ctx 被取消。
+// 每 1/3 个 TTL 续约一次，租约已过期（注册中心已删除该实例）时重新注册。
+func KeepAlive(ctx context.Context, registryURL string, r Registration) {
+	if r.LeaseTTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.LeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := RenewLease(registryURL, r.ServiceID)
+		if errors.Is(err, ErrNotRegistered) {
+			log.Printf("Lease of %s expired, registering again", r.ServiceID)
+			err = postRegistration(registryURL, r)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// 提供依赖服务的集合。
+// 同一进程中可以运行多个服务，每个服务（serviceUpdateHandler 或者 Watch）有自己的视图，只记录自己收到的实例；
+// services 是所有视图的并集，GetProvider 等函数从这里选择实例
 type providers struct {
-	services map[ServiceName][]string
-	mutex    *sync.RWMutex
+	services    map[ServiceName][]Instance
+	views       map[*providerView]bool
+	balancers   map[ServiceName]Balancer            // 每个依赖服务的负载均衡策略，未设置时随机选择
+	subscribers map[ServiceName]map[int]func(Patch) // 订阅了实例变化的回调
+	nextSubID   int
+	mutex       *sync.RWMutex
+}
+
+// 一个服务从注册中心收到的实例，只包含它依赖的服务
+type providerView struct {
+	owner    string // 服务的实例ID，Watch 使用的视图为空
+	services map[ServiceName][]Instance
 }
 
-func (p *providers) Update (pat patch) {
+// 实例ID为 owner 的服务的视图，同一个实例重新注册（例如重启）时沿用之前的视图
+func (p *providers) newView(owner string) *providerView {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
+	if v := p.viewOf(owner); v != nil {
+		return v
+	}
+	v := &providerView{owner: owner, services: make(map[ServiceName][]Instance)}
+	p.views[v] = true
+	return v
+}
 
-	for _, entry := range pat.Added {
-		if _, ok := p.services[entry.Name]; !ok {
-			p.services[entry.Name] = make([]string, 0)
+// 调用方持有锁
+func (p *providers) viewOf(owner string) *providerView {
+	if owner == "" {
+		return nil
+	}
+	for v := range p.views {
+		if v.owner == owner {
+			return v
 		}
-		p.services[entry.Name] = append(p.services[entry.Name], entry.URL)
 	}
+	return nil
+}
+
+// 服务取消注册后不再需要它的依赖服务
+func (p *providers) release(owner string) {
+	p.mutex.RLock()
+	v := p.viewOf(owner)
+	p.mutex.RUnlock()
+	if v != nil {
+		p.publish(p.dropView(v))
+	}
+}
 
-	for _, entry := range pat.Removed {
-		if providerURLs, ok := p.services[entry.Name]; ok {
-			for i, url := range providerURLs {
-				if url == entry.URL {
-					p.services[entry.Name] = append(providerURLs[:i], providerURLs[i+1:]...)
+// 把补丁应用到视图 v 和共享的缓存，返回缓存实际发生的变化（用于通知订阅者）。
+// 完整的实例列表只和 v 比较：v 中有但列表中没有的实例移除，不影响其他服务收到的实例；
+// 实例只有在所有视图中都不存在时才从缓存中移除
+func (p *providers) apply(v *providerView, pat Patch) Patch {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	removed := pat.Removed
+	if pat.Full {
+		removed = nil
+		for _, entries := range v.services {
+			for _, entry := range entries {
+				if indexOfEntry(pat.Added, entry) < 0 {
+					removed = append(removed, entry)
 				}
 			}
 		}
 	}
+
+	res := Patch{Added: pat.Added, Epoch: pat.Epoch, Revision: pat.Revision}
+	for _, entry := range pat.Added {
+		addEntry(v.services, entry)
+		addEntry(p.services, entry)
+	}
+	for _, entry := range removed {
+		removeEntry(v.services, entry)
+		if p.held(entry) {
+			continue
+		}
+		if removeEntry(p.services, entry) {
+			res.Removed = append(res.Removed, entry)
+			breakerSet.forget(entry.URL)
+		}
+	}
+	return res
+}
+
+// 丢弃视图（例如 Watch 结束），只在这个视图中的实例从缓存中移除，返回移除的实例
+func (p *providers) dropView(v *providerView) Patch {
+	p.mutex.Lock()
+	entries := v.services
+	v.services = make(map[ServiceName][]Instance)
+	delete(p.views, v)
+	p.mutex.Unlock()
+
+	var pat Patch
+	for _, list := range entries {
+		pat.Removed = append(pat.Removed, list...)
+	}
+	return p.apply(v, pat)
+}
+
+// 是否还有视图包含该实例，调用方持有锁
+func (p *providers) held(entry Instance) bool {
+	for v := range p.views {
+		if indexOfEntry(v.services[entry.Name], entry) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 同一个实例（ID 相同）重复出现时替换旧记录，避免缓存中出现重复的地址
+func addEntry(services map[ServiceName][]Instance, entry Instance) {
+	entries := services[entry.Name]
+	if i := indexOfEntry(entries, entry); i >= 0 {
+		entries[i] = entry
+		return
+	}
+	services[entry.Name] = append(entries, entry)
+}
+
+func removeEntry(services map[ServiceName][]Instance, entry Instance) bool {
+	entries := services[entry.Name]
+	i := indexOfEntry(entries, entry)
+	if i < 0 {
+		return false
+	}
+	services[entry.Name] = append(entries[:i:i], entries[i+1:]...)
+	return true
+}
+
+// 按实例ID查找条目；旧版本注册中心发送的条目没有ID，退化为按地址查找
+func indexOfEntry(entries []Instance, entry Instance) int {
+	for i, e := range entries {
+		if entry.ID != "" && e.ID == entry.ID {
+			return i
+		}
+		if entry.ID == "" && e.URL == entry.URL {
+			return i
+		}
+	}
+	return -1
+}
+
+// 该服务当前的所有实例
+func (p *providers) all(name ServiceName) []Instance {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return append([]Instance(nil), p.services[name]...)
+}
+
+func (p *providers) subscribe(name ServiceName, fn func(Patch)) func() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.subscribers[name] == nil {
+		p.subscribers[name] = make(map[int]func(Patch))
+	}
+	id := p.nextSubID
+	p.nextSubID++
+	p.subscribers[name][id] = fn
+	return func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		delete(p.subscribers[name], id)
+	}
+}
+
+// 把补丁按服务名拆开，分别通知订阅了该服务的回调
+func (p *providers) publish(pat Patch) {
+	byName := make(map[ServiceName]*Patch)
+	for _, entry := range pat.Added {
+		if byName[entry.Name] == nil {
+			byName[entry.Name] = &Patch{}
+		}
+		byName[entry.Name].Added = append(byName[entry.Name].Added, entry)
+	}
+	for _, entry := range pat.Removed {
+		if byName[entry.Name] == nil {
+			byName[entry.Name] = &Patch{}
+		}
+		byName[entry.Name].Removed = append(byName[entry.Name].Removed, entry)
+	}
+
+	for name, np := range byName {
+		p.mutex.RLock()
+		fns := make([]func(Patch), 0, len(p.subscribers[name]))
+		for _, fn := range p.subscribers[name] {
+			fns = append(fns, fn)
+		}
+		p.mutex.RUnlock()
+		// 回调在锁外执行，回调里可以再调用 GetProvider 等函数
+		for _, fn := range fns {
+			fn(*np)
+		}
+	}
 }
 
-// 按道理，根据 ServiceName 获取对应的 providerURLs 是多个，返回的是一个slice
-func (p providers) get(name ServiceName) (string,error) {
-	providers, ok := p.services[name]
+// 按该服务的负载均衡策略选出一个实例，allow 判断熔断器是否放行
+func (p *providers) pick(name ServiceName, key string, allow func(url string) bool) (Instance, Balancer, error) {
+	p.mutex.RLock()
+	instances := append([]Instance(nil), p.services[name]...)
+	b, ok := p.balancers[name]
+	p.mutex.RUnlock()
+
+	if len(instances) == 0 {
+		return Instance{}, nil, fmt.Errorf("no providers registered for %v", name)
+	}
 	if !ok {
-		return "", fmt.Errorf("no providers registered for %v", name)
+		b = randomBalancer{}
+	}
+	inst, err := pickAvailable(name, instances, b, key, allow)
+	return inst, b, err
+}
+
+// 用负载均衡策略选择实例，跳过熔断中的实例。
+// 由 Client 发送请求时 allow 为 breakerSet.acquire，会占用半开状态的试探机会，请求结果随后计入熔断器；
+// 只返回地址给调用方时为 breakerSet.available，结果不会上报，不能占用试探机会
+func pickAvailable(name ServiceName, instances []Instance, b Balancer, key string, allow func(url string) bool) (Instance, error) {
+	for len(instances) > 0 {
+		inst, err := b.Pick(instances, key)
+		if err != nil {
+			return Instance{}, err
+		}
+		if allow(inst.URL) {
+			return inst, nil
+		}
+		if t, ok := b.(RequestTracker); ok {
+			t.Done(inst)
+		}
+		remaining := make([]Instance, 0, len(instances)-1)
+		for _, other := range instances {
+			if other.ID != inst.ID {
+				remaining = append(remaining, other)
+			}
+		}
+		instances = remaining
+	}
+	return Instance{}, fmt.Errorf("all providers of %v are tripped by circuit breakers", name)
+}
+
+// 选出实例，并返回请求结束时需要调用的 done
+func (p *providers) pickTracked(name ServiceName, key string, allow func(url string) bool) (Instance, func(), error) {
+	inst, b, err := p.pick(name, key, allow)
+	if err != nil {
+		return Instance{}, nil, err
+	}
+	done := func() {}
+	if t, ok := b.(RequestTracker); ok {
+		done = func() { t.Done(inst) }
 	}
-	idx := int(rand.Float32() * float32(len(providers)))
-	return providers[idx], nil
+	return inst, done, nil
+}
+
+func (p *providers) setBalancer(name ServiceName, b Balancer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.balancers[name] = b
+}
+
+// 为依赖服务设置负载均衡策略，例如 SetBalancer(GradingService, NewRoundRobin())
+func SetBalancer(service ServiceName, b Balancer) {
+	prov.setBalancer(service, b)
+}
+
+// 选出一个实例，请求结束后必须调用返回的 done（最少未完成请求策略依赖它统计请求数）。
+// key 用于一致性哈希，例如按学生ID把同一个学生的请求固定到同一个实例。
+// 请求结果不会计入熔断器，因此不会占用半开实例的试探机会，需要熔断保护时使用 Client。
+func PickProvider(service ServiceName, key string) (url string, done func(), err error) {
+	inst, done, err := prov.pickTracked(service, key, breakerSet.available)
+	if err != nil {
+		return "", nil, err
+	}
+	return inst.URL, done, nil
+}
+
+// 获取服务当前的所有实例，用于向每个实例广播等场景
+func GetProviders(service ServiceName) ([]Instance, error) {
+	instances := prov.all(service)
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no providers registered for %v", service)
+	}
+	return instances, nil
+}
+
+// 订阅服务的实例变化：每当收到包含该服务的 Added/Removed 补丁时调用 fn，补丁只包含该服务的条目。
+// 回调在接收更新的请求中同步执行，不应长时间阻塞。返回值用于取消订阅。
+func Subscribe(service ServiceName, fn func(Patch)) (unsubscribe func()) {
+	return prov.subscribe(service, fn)
 }
 
 // 对外暴露的函数：根据 ServiceName 获得 providerURLs
 func GetProvider(service ServiceName) (string, error) {
-	return prov.get(service)
+	return GetProviderForKey(service, "")
+}
+
+// 按 key 获取实例地址，配合一致性哈希策略使用
+func GetProviderForKey(service ServiceName, key string) (string, error) {
+	url, done, err := PickProvider(service, key)
+	if err != nil {
+		return "", err
+	}
+	done()
+	return url, nil
 }
 
 var prov = providers{
-	services: make(map[ServiceName][]string),
-	mutex:    new(sync.RWMutex),
+	services:    make(map[ServiceName][]Instance),
+	balancers:   make(map[ServiceName]Balancer),
+	views:       make(map[*providerView]bool),
+	subscribers: make(map[ServiceName]map[int]func(Patch)),
+	mutex:       new(sync.RWMutex),
 }
\ No newline at end of file
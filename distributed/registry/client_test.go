@@ -0,0 +1,141 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func deliver(t *testing.T, suh *serviceUpdateHandler, p Patch) {
+	t.Helper()
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	suh.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/services", bytes.NewReader(data)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch responded with code %v", rec.Code)
+	}
+}
+
+func TestStaleFullPatchIsDropped(t *testing.T) {
+	const name = ServiceName("StaleFull")
+	suh := &serviceUpdateHandler{required: []ServiceName{name}, view: prov.newView("")}
+	t.Cleanup(func() { prov.dropView(suh.view) })
+
+	a := Instance{ID: "StaleFull-a", Name: name, URL: "http://a"}
+	b := Instance{ID: "StaleFull-b", Name: name, URL: "http://b"}
+	deliver(t, suh, Patch{Full: true, Added: []Instance{a}, Revision: 10})
+	deliver(t, suh, Patch{Added: []Instance{b}, Revision: 11, Previous: 10})
+	// 注册时发送的完整列表（版本 10）在版本 11 的增量补丁之后才到达
+	deliver(t, suh, Patch{Full: true, Added: []Instance{a}, Revision: 10})
+
+	if suh.revision != 11 {
+		t.Errorf("revision went back to %d", suh.revision)
+	}
+	if got := prov.all(name); len(got) != 2 {
+		t.Errorf("providers after a stale full patch: %v", got)
+	}
+
+	// 更新的完整列表仍然替换缓存
+	deliver(t, suh, Patch{Full: true, Added: []Instance{b}, Revision: 12})
+	if got := prov.all(name); len(got) != 1 || got[0].ID != b.ID {
+		t.Errorf("providers after a newer full patch: %v", got)
+	}
+}
+
+// 模拟注册中心：补齐时返回用 set 设置的当前状态
+func fakeChanges(t *testing.T) (server *httptest.Server, set func(Patch)) {
+	t.Helper()
+	var mutex sync.Mutex
+	var current Patch
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		json.NewEncoder(w).Encode(current)
+	}))
+	t.Cleanup(server.Close)
+	return server, func(p Patch) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		current = p
+	}
+}
+
+func TestPatchFromDifferentEpochResyncs(t *testing.T) {
+	const name = ServiceName("NewEpoch")
+	registry, setCurrent := fakeChanges(t)
+	suh := &serviceUpdateHandler{registryURL: registry.URL, required: []ServiceName{name}, view: prov.newView("")}
+	t.Cleanup(func() { prov.dropView(suh.view) })
+
+	a := Instance{ID: "NewEpoch-a", Name: name, URL: "http://a"}
+	b := Instance{ID: "NewEpoch-b", Name: name, URL: "http://b"}
+	c := Instance{ID: "NewEpoch-c", Name: name, URL: "http://c"}
+	const oldEpoch = 1 << 60
+	full := Patch{Full: true, Added: []Instance{a}, Epoch: oldEpoch, Revision: 50}
+	setCurrent(full)
+	deliver(t, suh, full)
+
+	// 注册中心换成了更小的纪元（例如改为集群模式，任期为 3）：增量补丁触发补齐，缓存被替换
+	setCurrent(Patch{Full: true, Added: []Instance{b}, Epoch: 3, Revision: 1})
+	deliver(t, suh, Patch{Added: []Instance{b}, Epoch: 3, Revision: 1})
+	if suh.epoch != 3 || suh.revision != 1 {
+		t.Errorf("handler is at epoch %d revision %d, want 3 and 1", suh.epoch, suh.revision)
+	}
+	if got := prov.all(name); len(got) != 1 || got[0].ID != b.ID {
+		t.Errorf("providers after a patch from a lower epoch: %v", got)
+	}
+
+	// 之前的纪元迟到的补丁同样触发补齐，缓存保持注册中心当前的状态
+	deliver(t, suh, Patch{Added: []Instance{a}, Epoch: oldEpoch, Revision: 51, Previous: 50})
+	deliver(t, suh, Patch{Full: true, Added: []Instance{a}, Epoch: oldEpoch, Revision: 52})
+	if suh.epoch != 3 {
+		t.Errorf("handler moved to epoch %d after stale patches", suh.epoch)
+	}
+	if got := prov.all(name); len(got) != 1 || got[0].ID != b.ID {
+		t.Errorf("providers after patches from an old epoch: %v", got)
+	}
+
+	// 注册中心无法访问时，仍然接受新纪元的完整列表
+	registry.Close()
+	deliver(t, suh, Patch{Full: true, Added: []Instance{c}, Epoch: 2, Revision: 1})
+	if suh.epoch != 2 || suh.revision != 1 {
+		t.Errorf("handler is at epoch %d revision %d, want 2 and 1", suh.epoch, suh.revision)
+	}
+	if got := prov.all(name); len(got) != 1 || got[0].ID != c.ID {
+		t.Errorf("providers after a full patch without resync: %v", got)
+	}
+}
+
+func TestRegistryRequestFailsOverFromHungNode(t *testing.T) {
+	saved := registryClient
+	registryClient = &http.Client{Timeout: 100 * time.Millisecond}
+	t.Cleanup(func() { registryClient = saved })
+
+	// 接受连接但一直不响应的节点
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(hung.Close)
+	t.Cleanup(func() { close(release) })
+	healthy, setCurrent := fakeChanges(t)
+	setCurrent(Patch{Full: true, Epoch: 1, Revision: 7})
+
+	start := time.Now()
+	p, err := FetchChanges(hung.URL+"/services,"+healthy.URL+"/services", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Epoch != 1 || p.Revision != 7 {
+		t.Errorf("got patch at epoch %d revision %d from the healthy node", p.Epoch, p.Revision)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("failover took %v", elapsed)
+	}
+}
@@ -0,0 +1,43 @@
+package registry
+
+// 注册中心地址的运行时配置：命令行参数 > 环境变量 > 默认值
+
+import (
+	"flag"
+	"os"
+)
+
+// 注册中心的默认监听端口与访问地址
+const (
+	DefaultServerPort  = ":3000"
+	DefaultServicesURL = "http://localhost" + DefaultServerPort + "/services"
+)
+
+// 环境变量名
+const (
+	ServicesURLEnv = "REGISTRY_URL"  // 服务端（各个服务）使用：注册中心的访问地址
+	ServerAddrEnv  = "REGISTRY_ADDR" // 注册中心使用：监听地址
+)
+
+// 读取环境变量中的注册中心地址，没有设置时使用默认地址
+func ServicesURLFromEnv() string {
+	return envOr(ServicesURLEnv, DefaultServicesURL)
+}
+
+// 读取环境变量中的注册中心监听地址，没有设置时使用默认端口
+func ServerAddrFromEnv() string {
+	return envOr(ServerAddrEnv, DefaultServerPort)
+}
+
+// 注册 -registry 命令行参数，需要在 flag.Parse 之前调用，解析后返回的指针即为最终地址。
+// 注册中心集群可以填写逗号分隔的多个节点地址。
+func ServicesURLFlag() *string {
+	return flag.String("registry", ServicesURLFromEnv(), "URL of the registry service, comma-separated for a cluster (env "+ServicesURLEnv+")")
+}
+
+func envOr(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
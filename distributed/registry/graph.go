@@ -0,0 +1,215 @@
+package registry
+
+// 服务依赖图：节点为服务名，A 的某个实例声明依赖 B 时有一条 A -> B 的边。
+// 注册时拒绝会形成环的依赖；GET /services/graph 返回依赖图（JSON，或者 ?format=dot 返回 Graphviz DOT），
+// 并列出依赖的服务没有健康实例的服务，便于排查例如 Portal 为什么找不到 GradingService。
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// 注册会使依赖关系形成环
+var ErrDependencyCycle = errors.New("dependency cycle")
+
+// 依赖图中的一个服务
+type ServiceNode struct {
+	Name      ServiceName
+	Instances int           // 注册的实例数，只被依赖而没有注册的服务为 0
+	Healthy   int           // 可路由的实例数
+	Requires  []ServiceName // 依赖的服务（所有实例声明的并集）
+	Missing   []ServiceName // 依赖的服务中没有健康实例的
+}
+
+type DependencyGraph struct {
+	Services    []ServiceNode // 按服务名排序
+	Order       []ServiceName // 启动顺序：被依赖的服务在前
+	Unsatisfied []ServiceName // 有依赖缺少健康实例的服务
+}
+
+// 按服务名汇总的依赖关系，skipID 对应的实例不计入（重新注册时用新的记录代替旧的）
+func dependencyEdges(regs []Registration, skipID string) map[ServiceName]map[ServiceName]bool {
+	edges := make(map[ServiceName]map[ServiceName]bool)
+	for _, reg := range regs {
+		if reg.ServiceID == skipID {
+			continue
+		}
+		addEdges(edges, reg)
+	}
+	return edges
+}
+
+func addEdges(edges map[ServiceName]map[ServiceName]bool, reg Registration) {
+	if edges[reg.ServiceName] == nil {
+		edges[reg.ServiceName] = make(map[ServiceName]bool)
+	}
+	for _, req := range reg.RequiredServices {
+		edges[reg.ServiceName][req] = true
+	}
+}
+
+// 检查加入 reg 之后依赖关系是否有环，有环时返回环上的路径。
+// 调用方持有写锁，检查和插入之间服务表不会变化，并发的注册不会一起形成环
+func (r *registry) checkCycle(reg Registration) error {
+	edges := dependencyEdges(r.registrations, reg.ServiceID)
+	addEdges(edges, reg)
+
+	// 从 reg 依赖的每个服务出发深度优先搜索，能回到 reg 说明有环
+	visited := make(map[ServiceName]bool)
+	var path []ServiceName
+	var visit func(name ServiceName) bool
+	visit = func(name ServiceName) bool {
+		path = append(path, name)
+		if name == reg.ServiceName {
+			return true
+		}
+		if !visited[name] {
+			visited[name] = true
+			for _, next := range sortedNames(edges[name]) {
+				if visit(next) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	for _, req := range reg.RequiredServices {
+		path = []ServiceName{reg.ServiceName}
+		if visit(req) {
+			parts := make([]string, len(path))
+			for i, name := range path {
+				parts[i] = string(name)
+			}
+			return fmt.Errorf("%w: %s", ErrDependencyCycle, strings.Join(parts, " -> "))
+		}
+	}
+	return nil
+}
+
+func sortedNames(set map[ServiceName]bool) []ServiceName {
+	names := make([]ServiceName, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// 根据当前的服务表构建依赖图
+func (r *registry) graph() DependencyGraph {
+	r.mutex.RLock()
+	edges := dependencyEdges(r.registrations, "")
+	instances := make(map[ServiceName]int)
+	healthy := make(map[ServiceName]int)
+	for _, reg := range r.registrations {
+		instances[reg.ServiceName]++
+		if reg.routable() {
+			healthy[reg.ServiceName]++
+		}
+	}
+	r.mutex.RUnlock()
+
+	// 只被依赖、没有注册的服务也作为节点
+	all := make(map[ServiceName]bool)
+	for name, reqs := range edges {
+		all[name] = true
+		for req := range reqs {
+			all[req] = true
+		}
+	}
+
+	var g DependencyGraph
+	for _, name := range sortedNames(all) {
+		node := ServiceNode{
+			Name:      name,
+			Instances: instances[name],
+			Healthy:   healthy[name],
+			Requires:  sortedNames(edges[name]),
+		}
+		for _, req := range node.Requires {
+			if healthy[req] == 0 {
+				node.Missing = append(node.Missing, req)
+			}
+		}
+		if len(node.Missing) > 0 {
+			g.Unsatisfied = append(g.Unsatisfied, name)
+		}
+		g.Services = append(g.Services, node)
+	}
+
+	// 拓扑排序（依赖关系无环）：依赖的服务先于依赖它的服务
+	done := make(map[ServiceName]bool)
+	var visit func(name ServiceName)
+	visit = func(name ServiceName) {
+		if done[name] {
+			return
+		}
+		done[name] = true
+		for _, req := range sortedNames(edges[name]) {
+			visit(req)
+		}
+		g.Order = append(g.Order, name)
+	}
+	for _, name := range sortedNames(all) {
+		visit(name)
+	}
+	return g
+}
+
+// 以 Graphviz DOT 格式输出：没有健康实例的服务和缺失的依赖标红
+func (g DependencyGraph) dot() string {
+	var b strings.Builder
+	b.WriteString("digraph services {\n")
+	for _, node := range g.Services {
+		color := "black"
+		if node.Healthy == 0 {
+			color = "red"
+		}
+		label := fmt.Sprintf("%s\n%d/%d healthy", node.Name, node.Healthy, node.Instances)
+		fmt.Fprintf(&b, "  %q [label=%q, color=%s];\n", node.Name, label, color)
+	}
+	for _, node := range g.Services {
+		for _, req := range node.Requires {
+			color := "black"
+			for _, missing := range node.Missing {
+				if missing == req {
+					color = "red"
+				}
+			}
+			fmt.Fprintf(&b, "  %q -> %q [color=%s];\n", node.Name, req, color)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// GET /services/graph 返回 JSON，GET /services/graph?format=dot 返回 DOT
+func (s *RegistryService) serveGraph(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	g := s.reg.graph()
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		w.Header().Add("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(g)
+		if err != nil {
+			log.Println(err)
+		}
+	case "dot":
+		w.Header().Add("Content-Type", "text/vnd.graphviz")
+		_, err := w.Write([]byte(g.dot()))
+		if err != nil {
+			log.Println(err)
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,125 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func graphReg(id string, name ServiceName, status HealthStatus, requires ...ServiceName) Registration {
+	return Registration{ServiceID: id, ServiceName: name, ServiceURL: "http://" + id, RequiredServices: requires, Status: status}
+}
+
+func TestCheckCycle(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []Registration
+		add      Registration
+		wantPath string // 为空表示没有环
+	}{
+		{"no dependencies", nil, graphReg("a1", "A", HealthPassing), ""},
+		{"chain", []Registration{graphReg("b1", "B", HealthPassing, "C")}, graphReg("a1", "A", HealthPassing, "B"), ""},
+		{"self", nil, graphReg("a1", "A", HealthPassing, "A"), "A -> A"},
+		{"two services", []Registration{graphReg("b1", "B", HealthPassing, "A")}, graphReg("a1", "A", HealthPassing, "B"), "A -> B -> A"},
+		{"through another instance", []Registration{
+			graphReg("b1", "B", HealthPassing, "C"),
+			graphReg("c1", "C", HealthPassing),
+			graphReg("c2", "C", HealthPassing, "A"),
+		}, graphReg("a1", "A", HealthPassing, "B"), "A -> B -> C -> A"},
+		// 重新注册时旧的记录不计入：x1 之前作为 A 依赖 B，现在作为 B 依赖 A
+		{"re-registration replaces the old record", []Registration{
+			graphReg("x1", "A", HealthPassing, "B"),
+		}, graphReg("x1", "B", HealthPassing, "A"), ""},
+		{"other instance keeps the edge", []Registration{
+			graphReg("x1", "A", HealthPassing, "B"),
+			graphReg("x2", "A", HealthPassing, "B"),
+		}, graphReg("x1", "B", HealthPassing, "A"), "B -> A -> B"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRegistry(NewMemoryStorage())
+			r.registrations = append(r.registrations, tt.existing...)
+			err := r.checkCycle(tt.add)
+			if tt.wantPath == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrDependencyCycle) || !strings.HasSuffix(err.Error(), tt.wantPath) {
+				t.Fatalf("error %v, want a cycle %s", err, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestDependencyGraph(t *testing.T) {
+	s := NewRegistryServiceWithStorage(NewMemoryStorage())
+	s.reg.registrations = []Registration{
+		graphReg("portal", PortalService, HealthPassing, GradingService, LogService),
+		graphReg("grading", GradingService, HealthCritical, LogService),
+		graphReg("log", LogService, HealthPassing),
+		graphReg("new", "Orphan", HealthPassing, "Missing"),
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/services/graph", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("graph responded with code %v and content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var g DependencyGraph
+	if err := json.NewDecoder(rec.Body).Decode(&g); err != nil {
+		t.Fatal(err)
+	}
+	// 依赖的服务在前，其余按服务名排序
+	if got, want := fmt.Sprint(g.Order), "[LogService GradingService Missing Orphan Portal]"; got != want {
+		t.Errorf("order %v, want %v", got, want)
+	}
+	if got, want := fmt.Sprint(g.Unsatisfied), "[Orphan Portal]"; got != want {
+		t.Errorf("unsatisfied %v, want %v", got, want)
+	}
+	for _, node := range g.Services {
+		switch node.Name {
+		case PortalService:
+			if fmt.Sprint(node.Requires) != "[GradingService LogService]" || fmt.Sprint(node.Missing) != "[GradingService]" {
+				t.Errorf("portal node %+v", node)
+			}
+		case GradingService:
+			if node.Instances != 1 || node.Healthy != 0 {
+				t.Errorf("grading node %+v", node)
+			}
+		case "Missing":
+			if node.Instances != 0 {
+				t.Errorf("unregistered dependency has %d instances", node.Instances)
+			}
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/services/graph?format=dot", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/vnd.graphviz" {
+		t.Fatalf("dot responded with code %v and content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	dot := rec.Body.String()
+	for _, want := range []string{
+		"digraph services {\n",
+		`"GradingService" [label="GradingService\n0/1 healthy", color=red];`,
+		`"LogService" [label="LogService\n1/1 healthy", color=black];`,
+		`"Portal" -> "GradingService" [color=red];`,
+		`"Portal" -> "LogService" [color=black];`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("dot output is missing %q:\n%s", want, dot)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/services/graph?format=svg", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown format responded with code %v", rec.Code)
+	}
+}
@@ -0,0 +1,78 @@
+package registry
+
+// 健康状态：心跳接口返回的健康报告，注册中心据此决定是否把流量路由到该实例
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+type HealthStatus string
+
+const (
+	HealthPassing  = HealthStatus("passing")  // 正常，可以接收流量
+	HealthWarning  = HealthStatus("warning")  // 可以工作但有异常，不再路由流量
+	HealthCritical = HealthStatus("critical") // 无法正常工作
+	HealthUnknown  = HealthStatus("unknown")  // 注册中心重启后恢复的实例，还没有重新检查
+)
+
+// 严重程度，数值越大越严重
+func (s HealthStatus) severity() int {
+	switch s {
+	case HealthPassing:
+		return 0
+	case HealthWarning:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// 单个检查项的结果
+type CheckResult struct {
+	Name   string
+	Status HealthStatus
+	Output string // 说明信息，例如失败原因
+}
+
+// 心跳接口返回的健康报告
+type HealthReport struct {
+	Status HealthStatus // 整体状态：取所有检查项中最严重的一个
+	Checks []CheckResult
+}
+
+// 汇总检查结果，没有检查项时为 passing
+func NewHealthReport(checks []CheckResult) HealthReport {
+	report := HealthReport{Status: HealthPassing, Checks: checks}
+	for _, c := range checks {
+		if c.Status.severity() > report.Status.severity() {
+			report.Status = c.Status
+		}
+	}
+	return report
+}
+
+// 请求心跳地址并解析健康报告。
+// 返回 error 表示实例不可达；能连通但响应体不是健康报告时（旧版本服务只返回 200），按状态码判断。
+func checkHealth(client *http.Client, heartbeatURL string) (HealthStatus, error) {
+	res, err := client.Get(heartbeatURL)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	var report HealthReport
+	if json.Unmarshal(body, &report) == nil && report.Status != "" {
+		return report.Status, nil
+	}
+	if res.StatusCode == http.StatusOK {
+		return HealthPassing, nil
+	}
+	return "", fmt.Errorf("heartbeat responded with code %v", res.StatusCode)
+}
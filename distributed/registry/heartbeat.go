@@ -0,0 +1,107 @@
+package registry
+
+// 心跳检查：每个实例一个协程，按注册时声明的 HeartbeatPolicy 独立调度，
+// 一个响应慢的服务不会拖慢其他服务的检查
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// 开始对所有已注册的实例进行心跳检查，之后注册的实例在应用注册时（afterApply）自动开始
+func (r *registry) startHealthChecks() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.monitoring = true
+	for _, reg := range r.registrations {
+		r.startChecker(reg)
+	}
+}
+
+// 停止所有心跳检查（集群模式下不再是主节点时）
+func (r *registry) stopHealthChecks() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.monitoring = false
+	for id := range r.checkers {
+		r.stopChecker(id)
+	}
+}
+
+// 为实例启动心跳检查协程，已有的协程先停止；调用方需持有锁
+func (r *registry) startChecker(reg Registration) {
+	r.stopChecker(reg.ServiceID)
+	// 租约模式的实例由服务自己续约，不需要轮询
+	if !r.monitoring || reg.LeaseTTL > 0 || reg.HeartbeatURL == "" {
+		return
+	}
+	stop := make(chan struct{})
+	r.checkers[reg.ServiceID] = stop
+	go r.watchHealth(reg, stop)
+}
+
+// 停止实例的心跳检查协程；调用方需持有锁
+func (r *registry) stopChecker(id string) {
+	if stop, ok := r.checkers[id]; ok {
+		close(stop)
+		delete(r.checkers, id)
+	}
+}
+
+// 按策略定期检查一个实例：
+// 连不上时立即标记为 critical 停止路由，连续失败 FailureThreshold 次后移除实例；
+// 不健康的实例连续通过 SuccessThreshold 次检查后才恢复为 passing。
+func (r *registry) watchHealth(reg Registration, stop <-chan struct{}) {
+	policy := reg.Heartbeat.withDefaults()
+	client := &http.Client{Timeout: policy.Timeout}
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	current := reg.Status
+	failures, passes := 0, 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		status, err := checkHealth(client, reg.HeartbeatURL)
+		// 检查期间实例重新注册（例如用同一个ID重启）时已经有新的检查协程，这次的结果不能再用于移除或者更新状态
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err != nil {
+			failures++
+			passes = 0
+			log.Printf("Heartbeat check failed for %v (%d/%d): %v", reg.ServiceID, failures, policy.FailureThreshold, err)
+			if failures >= policy.FailureThreshold {
+				err = r.remove(reg.ServiceID)
+				if err != nil {
+					log.Println(err)
+				}
+				return
+			}
+			current = HealthCritical
+			r.setStatus(reg.ServiceID, current)
+			continue
+		}
+
+		failures = 0
+		log.Printf("Heartbeat check for %v: %s", reg.ServiceID, status)
+		if status == HealthPassing && current != HealthPassing {
+			passes++
+			if passes < policy.SuccessThreshold {
+				continue
+			}
+		}
+		passes = 0
+		current = status
+		r.setStatus(reg.ServiceID, current)
+	}
+}
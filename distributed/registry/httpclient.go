@@ -0,0 +1,209 @@
+package registry
+
+// 按服务名访问服务的 HTTP 客户端：通过注册中心解析出实例后发送请求，
+// 连接失败或返回 5xx 时退避一段时间，换一个实例重试。
+// 非幂等的请求（POST、PATCH）可能已经被处理，只在连接没有建立时重试，除非调用方用 WithRetry 声明可以重复发送
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 默认的重试参数
+const (
+	DefaultMaxAttempts = 3
+	DefaultBackoff     = 100 * time.Millisecond
+)
+
+type Client struct {
+	HTTPClient  *http.Client  // 实际发送请求的客户端，为空时使用 http.DefaultClient
+	MaxAttempts int           // 每次调用最多尝试的次数（包括第一次）
+	Backoff     time.Duration // 第一次重试前的等待时间，之后每次翻倍
+}
+
+func NewClient() *Client {
+	return &Client{
+		HTTPClient:  http.DefaultClient,
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+	}
+}
+
+// 默认客户端
+var DefaultClient = NewClient()
+
+type balanceKey struct{}
+
+// 在 ctx 中携带负载均衡使用的 key（一致性哈希），例如学生ID
+func WithBalanceKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, balanceKey{}, key)
+}
+
+func balanceKeyFrom(ctx context.Context) string {
+	key, _ := ctx.Value(balanceKey{}).(string)
+	return key
+}
+
+type retryKey struct{}
+
+// 声明 ctx 中的请求可以重复发送（例如服务端会去重），非幂等的请求失败或返回 5xx 时也换实例重试
+func WithRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryKey{}, true)
+}
+
+// 请求失败后是否可以重新发送：幂等的方法，或者调用方用 WithRetry 声明过
+func retryable(ctx context.Context, method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	retry, _ := ctx.Value(retryKey{}).(bool)
+	return retry
+}
+
+// 连接没有建立，请求一定没有发送到服务端
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// GET 请求，例如 client.Get(ctx, GradingService, "/students")
+func (c *Client) Get(ctx context.Context, service ServiceName, path string) (*http.Response, error) {
+	return c.Do(ctx, service, http.MethodGet, path, "", nil)
+}
+
+// POST 请求
+func (c *Client) Post(ctx context.Context, service ServiceName, path, contentType string, body io.Reader) (*http.Response, error) {
+	return c.Do(ctx, service, http.MethodPost, path, contentType, body)
+}
+
+// 向服务发送请求。请求体会先读入内存，以便重试时重新发送（只重试幂等的方法，见 WithRetry）；
+// 整个调用（包括重试和退避）的截止时间由 ctx 决定。
+func (c *Client) Do(ctx context.Context, service ServiceName, method, path, contentType string, body io.Reader) (*http.Response, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	attempts := c.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+	backoff := c.Backoff
+	retry := retryable(ctx, method)
+
+	tried := make(map[string]bool)
+	sent := 0
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		inst, done, err := c.pick(service, balanceKeyFrom(ctx), tried)
+		if err != nil {
+			return nil, err
+		}
+		tried[inst.ID] = true
+		sent++
+
+		req, err := http.NewRequestWithContext(ctx, method, inst.URL+path, bytes.NewReader(payload))
+		if err != nil {
+			done()
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		res, err := httpClient.Do(req)
+		if err != nil {
+			done()
+			// 调用方的截止时间已到，不再重试，也不计入熔断
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			breakerSet.failure(inst.URL)
+			lastErr = err
+			// 请求可能已经到达服务端，不能重复发送
+			if !retry && !isDialError(err) {
+				break
+			}
+			continue
+		}
+		if res.StatusCode >= http.StatusInternalServerError {
+			breakerSet.failure(inst.URL)
+		} else {
+			breakerSet.success(inst.URL)
+		}
+		// 5xx：最后一次尝试或者不能重试时把响应交给调用方处理，否则换一个实例重试
+		if res.StatusCode >= http.StatusInternalServerError && retry && attempt < attempts-1 {
+			res.Body.Close()
+			done()
+			lastErr = fmt.Errorf("%v responded with code %v", inst.URL, res.StatusCode)
+			continue
+		}
+		// 调用方关闭响应体时请求才算结束
+		res.Body = &trackedBody{ReadCloser: res.Body, done: done}
+		return res, nil
+	}
+	return nil, fmt.Errorf("request to %v failed after %d attempts: %w", service, sent, lastErr)
+}
+
+// 关闭时通知负载均衡策略请求已经结束
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// 第一次按负载均衡策略选择实例；重试时优先选择还没有尝试过的实例，都尝试过了就从全部实例中随机选择
+func (c *Client) pick(service ServiceName, key string, tried map[string]bool) (Instance, func(), error) {
+	if len(tried) == 0 {
+		return prov.pickTracked(service, key, breakerSet.acquire)
+	}
+
+	instances := prov.all(service)
+	if len(instances) == 0 {
+		return Instance{}, nil, fmt.Errorf("no providers registered for %v", service)
+	}
+	untried := make([]Instance, 0, len(instances))
+	for _, inst := range instances {
+		if !tried[inst.ID] {
+			untried = append(untried, inst)
+		}
+	}
+	if len(untried) > 0 {
+		instances = untried
+	}
+	inst, err := pickAvailable(service, instances, randomBalancer{}, "", breakerSet.acquire)
+	if err != nil {
+		return Instance{}, nil, err
+	}
+	return inst, func() {}, nil
+}
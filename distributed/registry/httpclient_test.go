@@ -0,0 +1,67 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// 两个总是返回 500 的实例，返回收到的请求总数
+func failingProviders(t *testing.T, name ServiceName) *atomic.Int32 {
+	t.Helper()
+	var hits atomic.Int32
+	view := prov.newView("")
+	for _, id := range []string{"a", "b"} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		t.Cleanup(srv.Close)
+		prov.apply(view, Patch{Added: []Instance{{ID: string(name) + "-" + id, Name: name, URL: srv.URL}}})
+	}
+	t.Cleanup(func() { prov.dropView(view) })
+	return &hits
+}
+
+func TestClientRetriesIdempotentRequests(t *testing.T) {
+	hits := failingProviders(t, "RetryGet")
+	c := &Client{MaxAttempts: 3}
+	res, err := c.Get(context.Background(), "RetryGet", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got := hits.Load(); got != 3 {
+		t.Errorf("GET was sent %d times, want 3", got)
+	}
+}
+
+func TestClientDoesNotRetryPost(t *testing.T) {
+	hits := failingProviders(t, "RetryPost")
+	c := &Client{MaxAttempts: 3}
+	res, err := c.Post(context.Background(), "RetryPost", "/", "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("POST responded with code %v", res.StatusCode)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("POST was sent %d times, want 1", got)
+	}
+
+	// 调用方声明可以重复发送
+	hits.Store(0)
+	res, err = c.Post(WithRetry(context.Background()), "RetryPost", "/", "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got := hits.Load(); got != 3 {
+		t.Errorf("POST with WithRetry was sent %d times, want 3", got)
+	}
+}
@@ -0,0 +1,877 @@
+package registry
+
+// 注册中心集群：简化的 Raft 实现（领导者选举 + 日志复制），节点之间通过 HTTP 通信。
+// 注册表的写操作作为日志条目复制到多数节点后，由每个节点按相同的顺序应用；
+// 节点 ID 就是它的访问地址（如 http://localhost:3001），跟随者据此把写请求重定向到主节点。
+// 任期、投票和日志通过存储（raftStorage）持久化，在回应投票和复制请求之前写入，节点重启后从存储恢复。
+// 已应用的日志每隔 DefaultSnapshotEvery 条压缩成快照（当时的完整服务表），之前的日志随之丢弃；
+// 节点重启后先恢复快照，再重新应用快照之后已提交的日志，写操作是幂等的，结果与重启前相同。
+// 跟随者落后太多、需要的日志已经被压缩时，主节点改为发送快照。
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type raftRole string
+
+const (
+	raftFollower  = raftRole("follower")
+	raftCandidate = raftRole("candidate")
+	raftLeader    = raftRole("leader")
+)
+
+const (
+	raftTickInterval      = 20 * time.Millisecond
+	raftHeartbeatInterval = 100 * time.Millisecond
+	raftElectionTimeout   = 500 * time.Millisecond // 实际超时在 [T, 2T) 之间随机
+	raftRPCTimeout        = 300 * time.Millisecond
+	raftProposeTimeout    = 3 * time.Second
+)
+
+var errNotLeader = errors.New("registry node is not the leader")
+
+// Raft 需要持久化的状态。NewFileStorage 和 NewMemoryStorage 返回的存储都实现了这个接口
+type raftStorage interface {
+	// 保存当前任期和本任期投票给的节点
+	saveRaftState(term uint64, votedFor string) error
+	// 从下标 index 开始写入日志条目，丢弃该位置及之后原有的条目
+	saveRaftEntries(index uint64, entries []raftEntry) error
+	// 保存快照，并用快照之后的条目 entries 替换保存的日志
+	saveRaftSnapshot(snap raftSnapshot, entries []raftEntry) error
+	// 读取保存的状态、快照和快照之后的日志
+	loadRaft() (term uint64, votedFor string, snap raftSnapshot, entries []raftEntry, err error)
+}
+
+// 由 Raft 复制的状态机，即注册表
+type raftStateMachine interface {
+	// 应用一条已提交的日志
+	apply(cmd command) applyResult
+	// 当前的完整服务表，用于生成快照
+	state() []Registration
+	// 用快照中的服务表替换当前状态
+	restore(regs []Registration)
+	// 本节点成为主节点（term 为作为主节点的任期）或者不再是主节点，在锁外按顺序调用
+	leadershipChanged(isLeader bool, term uint64)
+}
+
+// 快照：下标 Index（任期 Term）及之前的日志应用之后的服务表
+type raftSnapshot struct {
+	Index         uint64
+	Term          uint64
+	Registrations []Registration
+}
+
+type raftEntry struct {
+	Term    uint64
+	Command command
+}
+
+type voteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type voteResponse struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+type appendRequest struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []raftEntry
+	LeaderCommit uint64
+}
+
+type appendResponse struct {
+	Term      uint64
+	Success   bool
+	NextIndex uint64 // 失败时提示主节点下一次从哪里开始发送
+}
+
+// 主节点发给落后的跟随者的快照，回应与 appendResponse 相同
+type snapshotRequest struct {
+	Term     uint64
+	LeaderID string
+	Snapshot raftSnapshot
+}
+
+// 节点状态，GET /raft/status 返回
+type RaftStatus struct {
+	ID            string
+	Role          raftRole
+	Term          uint64
+	Leader        string
+	LastIndex     uint64
+	CommitIndex   uint64
+	SnapshotIndex uint64
+}
+
+// 等待提交结果的写操作
+type raftWaiter struct {
+	term uint64
+	ch   chan applyResult
+}
+
+type raftNode struct {
+	id     string
+	peers  []string
+	client *http.Client
+
+	store         raftStorage      // 为 nil 时只保存在内存中
+	sm            raftStateMachine // 应用已提交的日志
+	snapshotEvery uint64           // 已应用的日志超过多少条时压缩成快照
+	leaderCh      chan struct{}    // 主节点身份变化时唤醒通知协程，通知协程读取 leaderTerm
+	done          chan struct{}    // stop 时关闭
+
+	applyMutex       sync.Mutex // 修改状态机（应用日志、安装快照）时持有，在 mutex 之前加锁
+	mutex            sync.Mutex
+	role             raftRole
+	stopped          bool
+	leaderTerm       uint64 // 作为主节点的任期，不是主节点时为 0
+	term             uint64
+	votedFor         string
+	leaderID         string
+	snapshot         raftSnapshot // 最近的快照，之前的日志已经丢弃
+	entries          []raftEntry  // entries[0] 为占位，对应快照的位置；下标 i 的条目为 entries[i-snapshot.Index]
+	commitIndex      uint64
+	lastApplied      uint64
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	inflight         map[string]bool // 每个节点同时只有一个复制请求
+	electionDeadline time.Time
+	nextHeartbeat    time.Time
+	waiters          map[uint64]raftWaiter
+	applyCh          chan struct{}
+}
+
+func newRaftNode(self string, peers []string, store raftStorage, sm raftStateMachine) *raftNode {
+	n := &raftNode{
+		id:            strings.TrimSuffix(self, "/"),
+		client:        &http.Client{Timeout: raftRPCTimeout},
+		store:         store,
+		sm:            sm,
+		snapshotEvery: DefaultSnapshotEvery,
+		leaderCh:      make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		role:          raftFollower,
+		entries:       make([]raftEntry, 1),
+		nextIndex:     make(map[string]uint64),
+		matchIndex:    make(map[string]uint64),
+		inflight:      make(map[string]bool),
+		waiters:       make(map[uint64]raftWaiter),
+		applyCh:       make(chan struct{}, 1),
+	}
+	for _, p := range peers {
+		p = strings.TrimSuffix(strings.TrimSpace(p), "/")
+		if p != "" && p != n.id {
+			n.peers = append(n.peers, p)
+		}
+	}
+	go n.notifyLoop(sm.leadershipChanged)
+	return n
+}
+
+// 在锁外按顺序通知主节点身份的变化。只通知最新的状态：中间短暂的变化可能被合并，
+// 但连任的主节点换了任期时先通知 false 再通知 true；停止时不再是主节点
+func (n *raftNode) notifyLoop(onLeaderChange func(bool, uint64)) {
+	var delivered uint64 // 已经通知过的主节点任期，0 表示不是主节点
+	for {
+		var current uint64
+		select {
+		case <-n.leaderCh:
+			n.mutex.Lock()
+			current = n.leaderTerm
+			n.mutex.Unlock()
+		case <-n.done:
+		}
+		if current != delivered {
+			if delivered != 0 {
+				onLeaderChange(false, delivered)
+			}
+			if current != 0 {
+				onLeaderChange(true, current)
+			}
+			delivered = current
+		}
+		select {
+		case <-n.done:
+			return
+		default:
+		}
+	}
+}
+
+// 主节点身份变化，调用方持有锁
+func (n *raftNode) setLeaderTerm(term uint64) {
+	n.leaderTerm = term
+	select {
+	case n.leaderCh <- struct{}{}:
+	default:
+	}
+}
+
+// 读取存储中的任期、投票、快照和日志，需要在 start 之前调用。有快照时用它替换状态机的状态，
+// 快照之前的日志都已提交并应用过
+func (n *raftNode) load() error {
+	if n.store == nil {
+		return nil
+	}
+	term, votedFor, snap, entries, err := n.store.loadRaft()
+	if err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	n.term = term
+	n.votedFor = votedFor
+	n.snapshot = snap
+	n.entries = append([]raftEntry{{Term: snap.Term}}, entries...)
+	n.commitIndex = snap.Index
+	n.lastApplied = snap.Index
+	n.mutex.Unlock()
+
+	if snap.Index > 0 {
+		n.sm.restore(snap.Registrations)
+	}
+	return nil
+}
+
+// 保存任期和投票，调用方持有锁
+func (n *raftNode) saveState() error {
+	if n.store == nil {
+		return nil
+	}
+	return n.store.saveRaftState(n.term, n.votedFor)
+}
+
+func (n *raftNode) start() {
+	n.mutex.Lock()
+	n.resetElectionTimer()
+	n.mutex.Unlock()
+	go n.run()
+	go n.applyLoop()
+}
+
+// 停止节点：不再参加选举、复制日志和处理请求，等待中的写操作返回 errNotLeader
+func (n *raftNode) stop() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.stopped {
+		return
+	}
+	n.stopped = true
+	n.role = raftFollower
+	n.leaderID = ""
+	n.leaderTerm = 0
+	for idx, w := range n.waiters {
+		w.ch <- applyResult{err: errNotLeader}
+		delete(n.waiters, idx)
+	}
+	close(n.done)
+}
+
+// 当前主节点的地址，以及本节点是否为主节点
+func (n *raftNode) leader() (string, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.leaderID, n.role == raftLeader
+}
+
+func (n *raftNode) status() RaftStatus {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return RaftStatus{
+		ID:            n.id,
+		Role:          n.role,
+		Term:          n.term,
+		Leader:        n.leaderID,
+		LastIndex:     n.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		SnapshotIndex: n.snapshot.Index,
+	}
+}
+
+// 提交一条写操作：只有主节点可以提交，等待日志复制到多数节点并在本节点应用后返回结果
+func (n *raftNode) propose(cmd command) (applyResult, error) {
+	n.mutex.Lock()
+	if n.role != raftLeader {
+		n.mutex.Unlock()
+		return applyResult{}, errNotLeader
+	}
+	entry := raftEntry{Term: n.term, Command: cmd}
+	idx := n.lastIndex() + 1
+	if err := n.saveEntries(idx, entry); err != nil {
+		n.mutex.Unlock()
+		return applyResult{}, err
+	}
+	n.entries = append(n.entries, entry)
+	ch := make(chan applyResult, 1)
+	n.waiters[idx] = raftWaiter{term: n.term, ch: ch}
+	n.advanceCommit()
+	n.broadcast()
+	n.mutex.Unlock()
+
+	select {
+	case res := <-ch:
+		return res, res.err
+	case <-time.After(raftProposeTimeout):
+		n.mutex.Lock()
+		delete(n.waiters, idx)
+		n.mutex.Unlock()
+		return applyResult{}, fmt.Errorf("%w: proposal timed out", errNotLeader)
+	}
+}
+
+func (n *raftNode) run() {
+	ticker := time.NewTicker(raftTickInterval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-n.done:
+			return
+		}
+		n.mutex.Lock()
+		switch {
+		case n.stopped:
+			// 已经停止，下一次循环时退出
+		case n.role == raftLeader:
+			if !now.Before(n.nextHeartbeat) {
+				n.broadcast()
+			}
+		case !now.Before(n.electionDeadline):
+			n.startElection()
+		}
+		n.mutex.Unlock()
+	}
+}
+
+// 以下方法调用方需持有锁
+
+func (n *raftNode) lastIndex() uint64 {
+	return n.snapshot.Index + uint64(len(n.entries)-1)
+}
+
+// 下标 index 的条目的任期，index 不能小于快照的位置
+func (n *raftNode) termAt(index uint64) uint64 {
+	return n.entries[index-n.snapshot.Index].Term
+}
+
+// 保存从下标 index 开始的日志条目
+func (n *raftNode) saveEntries(index uint64, entries ...raftEntry) error {
+	if n.store == nil {
+		return nil
+	}
+	return n.store.saveRaftEntries(index, entries)
+}
+
+func (n *raftNode) majority() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *raftNode) resetElectionTimer() {
+	n.electionDeadline = time.Now().Add(raftElectionTimeout + time.Duration(rand.Int63n(int64(raftElectionTimeout))))
+}
+
+// 发现更高的任期，或者收到当前主节点的消息时转为跟随者；新的任期保存失败时返回错误
+func (n *raftNode) becomeFollower(term uint64) error {
+	if n.role == raftLeader {
+		n.setLeaderTerm(0)
+	}
+	n.role = raftFollower
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leaderID = ""
+		return n.saveState()
+	}
+	return nil
+}
+
+func (n *raftNode) startElection() {
+	n.role = raftCandidate
+	n.term++
+	n.votedFor = n.id
+	n.leaderID = ""
+	n.resetElectionTimer()
+	if err := n.saveState(); err != nil {
+		// 没有保存投票不能参加选举，等下一次超时再试
+		log.Println(err)
+		n.role = raftFollower
+		return
+	}
+	term := n.term
+	votes := 1
+	if votes >= n.majority() {
+		n.becomeLeader()
+		return
+	}
+
+	req := voteRequest{
+		Term:         term,
+		CandidateID:  n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.termAt(n.lastIndex()),
+	}
+	for _, peer := range n.peers {
+		go func(peer string) {
+			var res voteResponse
+			if err := n.call(peer, "/raft/vote", req, &res); err != nil {
+				return
+			}
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+			if res.Term > n.term {
+				if err := n.becomeFollower(res.Term); err != nil {
+					log.Println(err)
+				}
+				return
+			}
+			if n.role != raftCandidate || n.term != term || !res.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.majority() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+func (n *raftNode) becomeLeader() {
+	n.role = raftLeader
+	n.leaderID = n.id
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+	// 提交一条空操作，使之前任期遗留的日志得到确认
+	noop := raftEntry{Term: n.term, Command: command{Op: opNoop}}
+	if err := n.saveEntries(n.lastIndex()+1, noop); err != nil {
+		log.Println(err)
+	} else {
+		n.entries = append(n.entries, noop)
+	}
+	n.advanceCommit()
+	n.broadcast()
+	log.Printf("registry node %v became leader for term %d\n", n.id, n.term)
+	n.setLeaderTerm(n.term)
+}
+
+// 向所有节点发送日志（没有新日志时就是心跳）
+func (n *raftNode) broadcast() {
+	n.nextHeartbeat = time.Now().Add(raftHeartbeatInterval)
+	for _, peer := range n.peers {
+		if n.inflight[peer] {
+			continue
+		}
+		next := n.nextIndex[peer]
+		if next < 1 {
+			next = 1
+		}
+		n.inflight[peer] = true
+		// 需要的日志已经压缩进快照，发送快照
+		if next <= n.snapshot.Index {
+			go n.sendSnapshot(peer, snapshotRequest{Term: n.term, LeaderID: n.id, Snapshot: n.snapshot})
+			continue
+		}
+		req := appendRequest{
+			Term:         n.term,
+			LeaderID:     n.id,
+			PrevLogIndex: next - 1,
+			PrevLogTerm:  n.termAt(next - 1),
+			Entries:      append([]raftEntry(nil), n.entries[next-n.snapshot.Index:]...),
+			LeaderCommit: n.commitIndex,
+		}
+		go n.replicate(peer, req)
+	}
+}
+
+func (n *raftNode) replicate(peer string, req appendRequest) {
+	var res appendResponse
+	err := n.call(peer, "/raft/append", req, &res)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.inflight[peer] = false
+	if err != nil {
+		return
+	}
+	if res.Term > n.term {
+		if err := n.becomeFollower(res.Term); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if n.role != raftLeader || n.term != req.Term {
+		return
+	}
+	if !res.Success {
+		if res.NextIndex >= 1 && res.NextIndex < n.nextIndex[peer] {
+			n.nextIndex[peer] = res.NextIndex
+		} else if n.nextIndex[peer] > 1 {
+			n.nextIndex[peer]--
+		}
+		// 立即用更早的日志重试
+		n.broadcast()
+		return
+	}
+	n.matched(peer, req.PrevLogIndex+uint64(len(req.Entries)))
+}
+
+// 跟随者的日志与主节点一致到下标 match；调用方需持有锁
+func (n *raftNode) matched(peer string, match uint64) {
+	if match > n.matchIndex[peer] {
+		n.matchIndex[peer] = match
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.advanceCommit()
+}
+
+func (n *raftNode) sendSnapshot(peer string, req snapshotRequest) {
+	var res appendResponse
+	err := n.call(peer, "/raft/snapshot", req, &res)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.inflight[peer] = false
+	if err != nil {
+		return
+	}
+	if res.Term > n.term {
+		if err := n.becomeFollower(res.Term); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if n.role != raftLeader || n.term != req.Term || !res.Success {
+		return
+	}
+	n.matched(peer, req.Snapshot.Index)
+}
+
+// 当前任期的日志复制到多数节点后提交
+func (n *raftNode) advanceCommit() {
+	for idx := n.lastIndex(); idx > n.commitIndex; idx-- {
+		if n.termAt(idx) != n.term {
+			break
+		}
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= idx {
+				count++
+			}
+		}
+		if count >= n.majority() {
+			n.commitIndex = idx
+			n.signalApply()
+			return
+		}
+	}
+}
+
+func (n *raftNode) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// 按顺序应用已提交的日志，并把结果交给等待的写操作；应用的日志足够多时压缩成快照
+func (n *raftNode) applyLoop() {
+	for {
+		select {
+		case <-n.applyCh:
+		case <-n.done:
+			return
+		}
+		n.applyMutex.Lock()
+		n.applyCommitted()
+		n.compact()
+		n.applyMutex.Unlock()
+	}
+}
+
+// 应用到 commitIndex 为止的日志；调用方需持有 applyMutex
+func (n *raftNode) applyCommitted() {
+	n.mutex.Lock()
+	first := n.lastApplied + 1
+	pending := append([]raftEntry(nil), n.entries[first-n.snapshot.Index:n.commitIndex-n.snapshot.Index+1]...)
+	n.lastApplied = n.commitIndex
+	n.mutex.Unlock()
+
+	for i, entry := range pending {
+		var res applyResult
+		if entry.Command.Op != opNoop {
+			res = n.sm.apply(entry.Command)
+		}
+		idx := first + uint64(i)
+		n.mutex.Lock()
+		w, ok := n.waiters[idx]
+		delete(n.waiters, idx)
+		n.mutex.Unlock()
+		if !ok {
+			continue
+		}
+		// 该位置的日志已经被新的主节点覆盖，写操作没有生效
+		if w.term != entry.Term {
+			res = applyResult{err: errNotLeader}
+		}
+		w.ch <- res
+	}
+}
+
+// 已应用的日志超过 snapshotEvery 条时，把状态机的当前状态保存为快照并丢弃之前的日志。
+// 调用方需持有 applyMutex：期间状态机不会变化，状态正好对应 lastApplied
+func (n *raftNode) compact() {
+	n.mutex.Lock()
+	due := n.lastApplied-n.snapshot.Index >= n.snapshotEvery
+	n.mutex.Unlock()
+	if !due {
+		return
+	}
+	regs := n.sm.state()
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	snap := raftSnapshot{Index: n.lastApplied, Term: n.termAt(n.lastApplied), Registrations: regs}
+	remaining := append([]raftEntry(nil), n.entries[snap.Index-n.snapshot.Index+1:]...)
+	if n.store != nil {
+		if err := n.store.saveRaftSnapshot(snap, remaining); err != nil {
+			// 日志还在，下一次再试
+			log.Println(err)
+			return
+		}
+	}
+	n.snapshot = snap
+	n.entries = append([]raftEntry{{Term: snap.Term}}, remaining...)
+}
+
+func (n *raftNode) handleVote(req voteRequest) voteResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if req.Term > n.term {
+		if err := n.becomeFollower(req.Term); err != nil {
+			log.Println(err)
+			return voteResponse{Term: n.term}
+		}
+	}
+	res := voteResponse{Term: n.term}
+	if req.Term < n.term || (n.votedFor != "" && n.votedFor != req.CandidateID) {
+		return res
+	}
+	// 候选人的日志至少和自己一样新才投票
+	lastTerm := n.termAt(n.lastIndex())
+	if req.LastLogTerm < lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex < n.lastIndex()) {
+		return res
+	}
+	n.votedFor = req.CandidateID
+	if err := n.saveState(); err != nil {
+		log.Println(err)
+		n.votedFor = ""
+		return res
+	}
+	n.resetElectionTimer()
+	res.VoteGranted = true
+	return res
+}
+
+func (n *raftNode) handleAppend(req appendRequest) appendResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if req.Term < n.term {
+		return appendResponse{Term: n.term}
+	}
+	if err := n.becomeFollower(req.Term); err != nil {
+		log.Println(err)
+		return appendResponse{Term: n.term}
+	}
+	n.leaderID = req.LeaderID
+	n.resetElectionTimer()
+
+	res := appendResponse{Term: n.term}
+	if req.PrevLogIndex > n.lastIndex() {
+		res.NextIndex = n.lastIndex() + 1
+		return res
+	}
+	// 快照之前的日志都已提交，与主节点一致，只处理快照之后的部分
+	if base := n.snapshot.Index; req.PrevLogIndex < base {
+		skip := min(base-req.PrevLogIndex, uint64(len(req.Entries)))
+		req.Entries = req.Entries[skip:]
+		req.PrevLogIndex += skip
+		if req.PrevLogIndex < base {
+			res.Success = true
+			return res
+		}
+		req.PrevLogTerm = n.snapshot.Term
+	}
+	if n.termAt(req.PrevLogIndex) != req.PrevLogTerm {
+		// 跳过整个冲突的任期
+		conflict := n.termAt(req.PrevLogIndex)
+		idx := req.PrevLogIndex
+		for idx > n.snapshot.Index+1 && n.termAt(idx-1) == conflict {
+			idx--
+		}
+		res.NextIndex = idx
+		return res
+	}
+
+	for i, entry := range req.Entries {
+		idx := req.PrevLogIndex + 1 + uint64(i)
+		if idx <= n.lastIndex() && n.termAt(idx) == entry.Term {
+			continue
+		}
+		// 先保存再修改内存中的日志；已提交的日志不会冲突，这里截断的都是未提交的
+		if err := n.saveEntries(idx, req.Entries[i:]...); err != nil {
+			log.Println(err)
+			return res
+		}
+		n.entries = append(n.entries[:idx-n.snapshot.Index], req.Entries[i:]...)
+		break
+	}
+
+	// 提交位置只会前进：过时的或者乱序到达的请求可能带着更小的 LeaderCommit
+	last := req.PrevLogIndex + uint64(len(req.Entries))
+	if commit := min(req.LeaderCommit, last); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.signalApply()
+	}
+	res.Success = true
+	return res
+}
+
+// 安装主节点发来的快照：快照之后与快照一致的日志保留，否则整个日志由快照替换
+func (n *raftNode) handleSnapshot(req snapshotRequest) appendResponse {
+	// 替换状态机期间不能同时应用日志
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+
+	res, installed := n.installSnapshot(req)
+	if installed {
+		n.sm.restore(req.Snapshot.Registrations)
+		// 快照之后可能还有已提交的日志
+		n.signalApply()
+	}
+	return res
+}
+
+// 保存快照并替换日志，返回是否需要用快照替换状态机的状态；调用方需持有 applyMutex
+func (n *raftNode) installSnapshot(req snapshotRequest) (appendResponse, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if req.Term < n.term {
+		return appendResponse{Term: n.term}, false
+	}
+	if err := n.becomeFollower(req.Term); err != nil {
+		log.Println(err)
+		return appendResponse{Term: n.term}, false
+	}
+	n.leaderID = req.LeaderID
+	n.resetElectionTimer()
+
+	res := appendResponse{Term: n.term, Success: true}
+	snap := req.Snapshot
+	// 已经应用过这个位置，快照没有新的内容
+	if snap.Index <= n.lastApplied {
+		return res, false
+	}
+	var remaining []raftEntry
+	if snap.Index <= n.lastIndex() && n.termAt(snap.Index) == snap.Term {
+		remaining = append(remaining, n.entries[snap.Index-n.snapshot.Index+1:]...)
+	}
+	if n.store != nil {
+		if err := n.store.saveRaftSnapshot(snap, remaining); err != nil {
+			log.Println(err)
+			return appendResponse{Term: n.term}, false
+		}
+	}
+	n.snapshot = snap
+	n.entries = append([]raftEntry{{Term: snap.Term}}, remaining...)
+	n.commitIndex = max(n.commitIndex, snap.Index)
+	n.lastApplied = snap.Index
+	// 被快照覆盖的写操作无法得知结果
+	for idx, w := range n.waiters {
+		if idx <= snap.Index {
+			w.ch <- applyResult{err: errNotLeader}
+			delete(n.waiters, idx)
+		}
+	}
+	return res, true
+}
+
+// 向其他节点发送请求
+func (n *raftNode) call(peer, path string, req, res any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := n.client.Post(peer+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v%v responded with code %v", peer, path, r.StatusCode)
+	}
+	return json.NewDecoder(r.Body).Decode(res)
+}
+
+// 节点之间的通信接口：POST /raft/vote、POST /raft/append、POST /raft/snapshot，以及查看状态的 GET /raft/status
+func (n *raftNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-n.done:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	var res any
+	switch {
+	case r.URL.Path == "/raft/status" && r.Method == http.MethodGet:
+		res = n.status()
+	case r.URL.Path == "/raft/vote" && r.Method == http.MethodPost:
+		var req voteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		res = n.handleVote(req)
+	case r.URL.Path == "/raft/append" && r.Method == http.MethodPost:
+		var req appendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		res = n.handleAppend(req)
+	case r.URL.Path == "/raft/snapshot" && r.Method == http.MethodPost:
+		var req snapshotRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		res = n.handleSnapshot(req)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,656 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试用的集群节点：应用的写操作记录在 applied 中，快照中每个写操作保存为一条注册记录
+type testNode struct {
+	raft  *raftNode
+	srv   *httptest.Server
+	addr  string
+	store Storage
+
+	mutex         sync.Mutex
+	applied       []command
+	leaderChanges []bool
+}
+
+func (tn *testNode) apply(cmd command) applyResult {
+	tn.mutex.Lock()
+	defer tn.mutex.Unlock()
+	tn.applied = append(tn.applied, cmd)
+	return applyResult{}
+}
+
+func (tn *testNode) state() []Registration {
+	tn.mutex.Lock()
+	defer tn.mutex.Unlock()
+	regs := make([]Registration, 0, len(tn.applied))
+	for _, cmd := range tn.applied {
+		regs = append(regs, Registration{ServiceID: cmd.ID})
+	}
+	return regs
+}
+
+func (tn *testNode) restore(regs []Registration) {
+	tn.mutex.Lock()
+	defer tn.mutex.Unlock()
+	tn.applied = tn.applied[:0]
+	for _, reg := range regs {
+		tn.applied = append(tn.applied, command{Op: opRemove, ID: reg.ServiceID})
+	}
+}
+
+func (tn *testNode) leadershipChanged(isLeader bool, term uint64) {
+	tn.mutex.Lock()
+	defer tn.mutex.Unlock()
+	tn.leaderChanges = append(tn.leaderChanges, isLeader)
+}
+
+func (tn *testNode) appliedIDs() []string {
+	tn.mutex.Lock()
+	defer tn.mutex.Unlock()
+	ids := make([]string, 0, len(tn.applied))
+	for _, cmd := range tn.applied {
+		ids = append(ids, cmd.ID)
+	}
+	return ids
+}
+
+// 在 addr 上启动节点，addr 为空时使用随机端口
+func startTestNode(t *testing.T, addr string, peers []string, store Storage) *testNode {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn := &testNode{addr: l.Addr().String(), store: store}
+	tn.raft = newRaftNode("http://"+tn.addr, peers, store.(raftStorage), tn)
+	if err := tn.raft.load(); err != nil {
+		t.Fatal(err)
+	}
+	tn.srv = httptest.NewUnstartedServer(tn.raft)
+	tn.srv.Listener.Close()
+	tn.srv.Listener = l
+	tn.srv.Start()
+	tn.raft.start()
+	t.Cleanup(tn.stop)
+	return tn
+}
+
+func (tn *testNode) stop() {
+	tn.raft.stop()
+	tn.srv.CloseClientConnections()
+	tn.srv.Close()
+}
+
+// 启动 n 个节点的集群
+func startTestCluster(t *testing.T, n int) []*testNode {
+	t.Helper()
+	listeners := make([]net.Listener, n)
+	peers := make([]string, n)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = l
+		peers[i] = "http://" + l.Addr().String()
+	}
+	// 先释放端口再在同一地址上启动节点
+	for _, l := range listeners {
+		l.Close()
+	}
+	nodes := make([]*testNode, n)
+	for i := range nodes {
+		nodes[i] = startTestNode(t, listeners[i].Addr().String(), peers, NewMemoryStorage())
+	}
+	return nodes
+}
+
+// 等待运行中的节点中恰好有一个主节点，并且其他节点都认可它
+func waitForLeader(t *testing.T, nodes []*testNode) *testNode {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var leader *testNode
+		leaders := 0
+		for _, tn := range nodes {
+			if _, isLeader := tn.raft.leader(); isLeader {
+				leader = tn
+				leaders++
+			}
+		}
+		if leaders == 1 {
+			agreed := true
+			for _, tn := range nodes {
+				if id, _ := tn.raft.leader(); id != leader.raft.id {
+					agreed = false
+				}
+			}
+			if agreed {
+				return leader
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+// 等待每个节点都按顺序应用了 want
+func waitForApplied(t *testing.T, nodes []*testNode, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for _, tn := range nodes {
+		for {
+			got := tn.appliedIDs()
+			if fmt.Sprint(got) == fmt.Sprint(want) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("node %v applied %v, want %v", tn.raft.id, got, want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+// 已应用的日志超过 every 条时压缩
+func setSnapshotEvery(nodes []*testNode, every uint64) {
+	for _, tn := range nodes {
+		tn.raft.mutex.Lock()
+		tn.raft.snapshotEvery = every
+		tn.raft.mutex.Unlock()
+	}
+}
+
+func propose(t *testing.T, leader *testNode, id string) {
+	t.Helper()
+	_, err := leader.raft.propose(command{Op: opRemove, ID: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRaftElection(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	term := leader.raft.status().Term
+	for _, tn := range nodes {
+		if st := tn.raft.status(); st.Term != term {
+			t.Errorf("node %v is in term %d, leader in term %d", st.ID, st.Term, term)
+		}
+	}
+	// 没有故障时主节点保持不变
+	time.Sleep(3 * raftElectionTimeout)
+	if again := waitForLeader(t, nodes); again != leader || again.raft.status().Term != term {
+		t.Errorf("leadership changed without failures: %v term %d", again.raft.id, again.raft.status().Term)
+	}
+}
+
+func TestRaftReplication(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("instance-%d", i)
+		propose(t, leader, id)
+		want = append(want, id)
+	}
+	waitForApplied(t, nodes, want)
+
+	for _, tn := range nodes {
+		if tn == leader {
+			continue
+		}
+		_, err := tn.raft.propose(command{Op: opRemove, ID: "x"})
+		if err == nil {
+			t.Errorf("follower %v accepted a proposal", tn.raft.id)
+		}
+	}
+}
+
+func TestRaftFailover(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+	propose(t, leader, "before")
+	waitForApplied(t, nodes, []string{"before"})
+
+	oldTerm := leader.raft.status().Term
+	leader.stop()
+	var rest []*testNode
+	for _, tn := range nodes {
+		if tn != leader {
+			rest = append(rest, tn)
+		}
+	}
+	newLeader := waitForLeader(t, rest)
+	if st := newLeader.raft.status(); st.Term <= oldTerm {
+		t.Errorf("new leader is in term %d, old leader was in term %d", st.Term, oldTerm)
+	}
+	// 剩下的两个节点仍然是多数，可以继续提交
+	propose(t, newLeader, "after")
+	waitForApplied(t, rest, []string{"before", "after"})
+}
+
+func TestRaftRestartKeepsLog(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+	propose(t, leader, "first")
+	waitForApplied(t, nodes, []string{"first"})
+
+	// 重启一个跟随者：从同一个存储恢复任期、投票和日志
+	var follower *testNode
+	for _, tn := range nodes {
+		if tn != leader {
+			follower = tn
+			break
+		}
+	}
+	before := follower.raft.status()
+	follower.stop()
+	var peers []string
+	for _, tn := range nodes {
+		peers = append(peers, "http://"+tn.addr)
+	}
+	restarted := startTestNode(t, follower.addr, peers, follower.store)
+	st := restarted.raft.status()
+	if st.Term < before.Term || st.LastIndex < before.LastIndex {
+		t.Fatalf("restarted node has term %d and last index %d, want at least %d and %d",
+			st.Term, st.LastIndex, before.Term, before.LastIndex)
+	}
+
+	for i, tn := range nodes {
+		if tn == follower {
+			nodes[i] = restarted
+		}
+	}
+	leader = waitForLeader(t, nodes)
+	propose(t, leader, "second")
+	waitForApplied(t, []*testNode{restarted}, []string{"first", "second"})
+}
+
+func TestRaftCommitIndexOnlyIncreases(t *testing.T) {
+	n := newRaftNode("http://a", []string{"http://b"}, nil, &testNode{})
+	entries := []raftEntry{{Term: 1}, {Term: 1}, {Term: 1}}
+	res := n.handleAppend(appendRequest{Term: 1, LeaderID: "http://b", Entries: entries, LeaderCommit: 3})
+	if !res.Success || n.status().CommitIndex != 3 {
+		t.Fatalf("append failed: %+v, commit index %d", res, n.status().CommitIndex)
+	}
+	// 迟到的请求只带着第一个条目和更小的提交位置
+	res = n.handleAppend(appendRequest{Term: 1, LeaderID: "http://b", Entries: entries[:1], LeaderCommit: 1})
+	if !res.Success {
+		t.Fatalf("stale append failed: %+v", res)
+	}
+	if got := n.status().CommitIndex; got != 3 {
+		t.Errorf("commit index went back to %d", got)
+	}
+	if got := n.status().LastIndex; got != 3 {
+		t.Errorf("stale append truncated the log to %d entries", got)
+	}
+}
+
+func TestRaftStopDoesNotBlockOnLeaderChanges(t *testing.T) {
+	tn := &testNode{}
+	n := newRaftNode("http://single", nil, nil, tn)
+	waitForChanges := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			tn.mutex.Lock()
+			got := fmt.Sprint(tn.leaderChanges)
+			tn.mutex.Unlock()
+			if got == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("leader changes %v, want %v", got, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	n.start()
+	// 单节点集群自己就是多数
+	waitForChanges("[true]")
+	n.stop()
+	if _, err := n.propose(command{Op: opNoop}); err == nil {
+		t.Error("stopped node accepted a proposal")
+	}
+	waitForChanges("[true false]")
+	rec := httptest.NewRecorder()
+	n.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/raft/status", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("stopped node responded with code %v", rec.Code)
+	}
+}
+
+func TestFileStorageRaftLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "registry.json")
+	store := NewFileStorage(file).(raftStorage)
+	if err := store.saveRaftState(3, "http://b"); err != nil {
+		t.Fatal(err)
+	}
+	entries := []raftEntry{
+		{Term: 1, Command: command{Op: opRemove, ID: "a"}},
+		{Term: 1, Command: command{Op: opRemove, ID: "b"}},
+		{Term: 2, Command: command{Op: opRemove, ID: "c"}},
+	}
+	if err := store.saveRaftEntries(1, entries); err != nil {
+		t.Fatal(err)
+	}
+	// 新的主节点覆盖了下标 2 之后的日志
+	if err := store.saveRaftEntries(2, []raftEntry{{Term: 3, Command: command{Op: opRemove, ID: "d"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	term, votedFor, _, got, err := NewFileStorage(file).(raftStorage).loadRaft()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if term != 3 || votedFor != "http://b" {
+		t.Errorf("loaded term %d vote %q, want 3 and http://b", term, votedFor)
+	}
+	if len(got) != 2 || got[0].Command.ID != "a" || got[1].Command.ID != "d" || got[1].Term != 3 {
+		t.Errorf("loaded entries %+v", got)
+	}
+}
+
+func TestRaftCompactsLog(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	setSnapshotEvery(nodes, 5)
+	leader := waitForLeader(t, nodes)
+
+	var want []string
+	for i := 0; i < 12; i++ {
+		id := fmt.Sprintf("instance-%d", i)
+		propose(t, leader, id)
+		want = append(want, id)
+	}
+	waitForApplied(t, nodes, want)
+	for _, tn := range nodes {
+		if st := tn.raft.status(); st.SnapshotIndex == 0 {
+			t.Errorf("node %v did not compact its log: %+v", st.ID, st)
+		}
+	}
+
+	// 重启一个跟随者：从快照恢复状态，再应用快照之后的日志
+	var follower *testNode
+	for _, tn := range nodes {
+		if tn != leader {
+			follower = tn
+			break
+		}
+	}
+	follower.stop()
+	var peers []string
+	for _, tn := range nodes {
+		peers = append(peers, "http://"+tn.addr)
+	}
+	restarted := startTestNode(t, follower.addr, peers, follower.store)
+	if st := restarted.raft.status(); st.SnapshotIndex == 0 || st.CommitIndex < st.SnapshotIndex {
+		t.Fatalf("restarted node did not load its snapshot: %+v", st)
+	}
+	waitForApplied(t, []*testNode{restarted}, want)
+}
+
+func TestRaftSnapshotCatchesUpLaggingFollower(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	setSnapshotEvery(nodes, 5)
+	leader := waitForLeader(t, nodes)
+	propose(t, leader, "first")
+	waitForApplied(t, nodes, []string{"first"})
+
+	// 一个跟随者停机期间，主节点把它缺少的日志压缩进了快照
+	var follower *testNode
+	var rest []*testNode
+	for _, tn := range nodes {
+		if tn != leader && follower == nil {
+			follower = tn
+		} else {
+			rest = append(rest, tn)
+		}
+	}
+	follower.stop()
+	want := []string{"first"}
+	for i := 0; i < 12; i++ {
+		id := fmt.Sprintf("instance-%d", i)
+		propose(t, leader, id)
+		want = append(want, id)
+	}
+	waitForApplied(t, rest, want)
+	if st := leader.raft.status(); st.SnapshotIndex <= follower.raft.status().LastIndex {
+		t.Fatalf("leader snapshot at %d does not cover the follower's missing entries", st.SnapshotIndex)
+	}
+
+	var peers []string
+	for _, tn := range nodes {
+		peers = append(peers, "http://"+tn.addr)
+	}
+	restarted := startTestNode(t, follower.addr, peers, follower.store)
+	setSnapshotEvery([]*testNode{restarted}, 5)
+	waitForApplied(t, []*testNode{restarted}, want)
+
+	propose(t, leader, "after")
+	waitForApplied(t, []*testNode{restarted}, append(want, "after"))
+	if st := restarted.raft.status(); st.SnapshotIndex == 0 {
+		t.Errorf("restarted node did not install a snapshot: %+v", st)
+	}
+}
+
+func TestFileStorageRaftSnapshot(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "registry.json")
+	store := NewFileStorage(file).(raftStorage)
+	entries := []raftEntry{
+		{Term: 1, Command: command{Op: opRemove, ID: "a"}},
+		{Term: 1, Command: command{Op: opRemove, ID: "b"}},
+		{Term: 2, Command: command{Op: opRemove, ID: "c"}},
+	}
+	if err := store.saveRaftEntries(1, entries); err != nil {
+		t.Fatal(err)
+	}
+	// 快照写入之后、日志重写之前崩溃：日志文件中快照之前的条目被跳过
+	snap := raftSnapshot{Index: 2, Term: 1, Registrations: []Registration{{ServiceID: "a"}, {ServiceID: "b"}}}
+	err := writeJSONFile(file+".raftsnap", func(enc *json.Encoder) error { return enc.Encode(snap) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func() {
+		t.Helper()
+		_, _, gotSnap, got, err := NewFileStorage(file).(raftStorage).loadRaft()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotSnap.Index != 2 || gotSnap.Term != 1 || len(gotSnap.Registrations) != 2 {
+			t.Errorf("loaded snapshot %+v", gotSnap)
+		}
+		if len(got) != 1 || got[0].Command.ID != "c" {
+			t.Errorf("loaded entries %+v", got)
+		}
+	}
+	check()
+
+	if err := store.saveRaftSnapshot(snap, entries[2:]); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	// 快照之后继续追加
+	if err := store.saveRaftEntries(4, []raftEntry{{Term: 2, Command: command{Op: opRemove, ID: "d"}}}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, got, err := NewFileStorage(file).(raftStorage).loadRaft()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1].Command.ID != "d" {
+		t.Errorf("loaded entries %+v", got)
+	}
+}
+
+func TestClusterLoadIgnoresStandaloneFiles(t *testing.T) {
+	store := NewMemoryStorage()
+	// 单机模式留下的快照和事件日志
+	if err := store.SaveSnapshot([]Registration{{ServiceName: LogService, ServiceID: "stale"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(Event{Type: EventAdd, Registration: Registration{ServiceName: GradingService, ServiceID: "stale-event"}}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewClusterRegistryService(store, "http://a", []string{"http://b"})
+	defer s.Stop()
+	if err := s.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if regs := s.reg.find("", false); len(regs) != 0 {
+		t.Errorf("cluster node started with registrations outside the raft log: %+v", regs)
+	}
+}
+
+// 通过 HTTP 运行的集群注册中心节点
+type clusterTestNode struct {
+	rs  *RegistryService
+	srv *httptest.Server
+	url string // 注册中心的访问地址，如 http://127.0.0.1:1234/services
+}
+
+// 启动 n 个 NewClusterRegistryService 节点，每个节点挂载完整的 /services 和 /raft/ 路由
+func startClusterRegistry(t *testing.T, n int) []*clusterTestNode {
+	t.Helper()
+	listeners := make([]net.Listener, n)
+	peers := make([]string, n)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = l
+		peers[i] = "http://" + l.Addr().String()
+	}
+	nodes := make([]*clusterTestNode, n)
+	for i, l := range listeners {
+		rs := NewClusterRegistryService(NewMemoryStorage(), peers[i], peers)
+		if err := rs.LoadFromFile(); err != nil {
+			t.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		rs.RegisterHandlers(mux)
+		srv := httptest.NewUnstartedServer(mux)
+		srv.Listener.Close()
+		srv.Listener = l
+		srv.Start()
+		rs.Setup()
+		tn := &clusterTestNode{rs: rs, srv: srv, url: peers[i] + "/services"}
+		t.Cleanup(func() {
+			tn.rs.Stop()
+			tn.srv.Close()
+		})
+		nodes[i] = tn
+	}
+	return nodes
+}
+
+// 等待集群选出所有节点都认可的主节点，返回主节点和跟随者
+func waitForClusterLeader(t *testing.T, nodes []*clusterTestNode) (*clusterTestNode, []*clusterTestNode) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var leader *clusterTestNode
+		var followers []*clusterTestNode
+		for _, tn := range nodes {
+			if _, isLeader := tn.rs.reg.raft.leader(); isLeader {
+				leader = tn
+			} else {
+				followers = append(followers, tn)
+			}
+		}
+		if leader != nil && len(followers) == len(nodes)-1 {
+			agreed := true
+			for _, tn := range followers {
+				if id, _ := tn.rs.reg.raft.leader(); id != leader.rs.reg.raft.id {
+					agreed = false
+				}
+			}
+			if agreed {
+				return leader, followers
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil, nil
+}
+
+// 等待每个节点上 name 服务的实例数为 want
+func waitForInstances(t *testing.T, nodes []*clusterTestNode, name ServiceName, want int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for _, tn := range nodes {
+		for {
+			got := tn.rs.reg.find(name, false)
+			if len(got) == want {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("node %v has %d instances of %v, want %d", tn.url, len(got), name, want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestClusterRegistryServiceHTTP(t *testing.T) {
+	nodes := startClusterRegistry(t, 3)
+	leader, followers := waitForClusterLeader(t, nodes)
+
+	// 跟随者把写请求重定向到主节点
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := noRedirect.Post(followers[0].url, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTemporaryRedirect || res.Header.Get("Location") != leader.url {
+		t.Fatalf("follower responded with %v to %q, want 307 to %q", res.StatusCode, res.Header.Get("Location"), leader.url)
+	}
+
+	// 客户端的地址列表以一个不可达的节点开头，之后是跟随者：请求跳过不可达的节点，由跟随者重定向给主节点
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL := dead.URL + "/services"
+	dead.Close()
+	registryURL := deadURL + "," + followers[0].url + "," + followers[1].url + "," + leader.url
+
+	const name = ServiceName("ClusterHTTP")
+	reg := Registration{ServiceName: name, ServiceID: "cluster-http-1", ServiceURL: "http://127.0.0.1:1"}
+	if err := postRegistration(registryURL, reg); err != nil {
+		t.Fatal(err)
+	}
+	waitForInstances(t, nodes, name, 1)
+
+	// 查询由第一个能访问的节点（跟随者）直接回答
+	regs, err := LookupServices(registryURL, name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regs) != 1 || regs[0].ServiceID != reg.ServiceID {
+		t.Errorf("lookup returned %+v", regs)
+	}
+
+	if err := ShutdownService(registryURL, reg.ServiceID); err != nil {
+		t.Fatal(err)
+	}
+	waitForInstances(t, nodes, name, 0)
+	if err := ShutdownService(registryURL, reg.ServiceID); err == nil {
+		t.Error("deleting a removed instance succeeded")
+	}
+}
@@ -2,6 +2,12 @@ package registry
 
 // 服务注册中心
 
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
 // 注册记录：服务名 + 访问地址
 // type Registration struct{
 // 	ServiceName ServiceName
@@ -9,10 +15,53 @@ package registry
 // }
 type Registration struct {
 	ServiceName      ServiceName
+	ServiceID        string		// 实例ID，同一个服务的多个副本各不相同；为空时由注册中心生成
 	ServiceURL       string
 	RequiredServices []ServiceName
 	ServiceUpdateURL string		// 更新url，用于自发送依赖服务的更新信息
 	HeartbeatURL    string		// 心跳url，用于自发送心跳信息
+	LeaseTTL        time.Duration	// 租约时长：大于0时使用租约模式，由服务定期续约，注册中心不再轮询心跳
+	Heartbeat       HeartbeatPolicy	// 心跳检查策略，未设置的字段使用默认值
+	Weight          int				// 权重，用于加权负载均衡，未设置时按 1 计算
+	Status          HealthStatus	// 健康状态，由注册中心根据心跳检查维护
+}
+
+// 心跳检查策略：注册中心为每个实例单独调度检查
+type HeartbeatPolicy struct {
+	Interval         time.Duration // 两次检查之间的间隔
+	Timeout          time.Duration // 单次检查的超时时间
+	FailureThreshold int           // 连续多少次连不上后移除实例
+	SuccessThreshold int           // 不健康的实例连续通过多少次检查后恢复路由
+}
+
+// 心跳检查策略的默认值
+const (
+	DefaultHeartbeatInterval         = 3 * time.Second
+	DefaultHeartbeatTimeout          = 2 * time.Second
+	DefaultHeartbeatFailureThreshold = 3
+	DefaultHeartbeatSuccessThreshold = 1
+)
+
+// 未设置的字段填充默认值
+func (p HeartbeatPolicy) withDefaults() HeartbeatPolicy {
+	if p.Interval <= 0 {
+		p.Interval = DefaultHeartbeatInterval
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = DefaultHeartbeatTimeout
+	}
+	if p.FailureThreshold <= 0 {
+		p.FailureThreshold = DefaultHeartbeatFailureThreshold
+	}
+	if p.SuccessThreshold <= 0 {
+		p.SuccessThreshold = DefaultHeartbeatSuccessThreshold
+	}
+	return p
+}
+
+// 只有健康状态为 passing 的实例才会被路由流量
+func (r Registration) routable() bool {
+	return r.Status == HealthPassing
 }
 
 type ServiceName string
@@ -25,14 +74,35 @@ const (
 	PortalService  = ServiceName("Portal") // Web应用，不是服务
 )
 
-// 一个记录
-type patchEntry struct {
-	Name ServiceName
-	URL  string
+// 没有实例ID的注册记录（旧版本的客户端或者文件）使用的ID：由服务名和地址得到，
+// 与 service.Start 按监听地址生成的ID格式相同，同一实例重新注册或者注册中心重启后ID不变
+func defaultServiceID(reg Registration) string {
+	u, err := url.Parse(reg.ServiceURL)
+	if err == nil && u.Host != "" {
+		return fmt.Sprintf("%s-%s", reg.ServiceName, u.Host)
+	}
+	return fmt.Sprintf("%s-%s", reg.ServiceName, reg.ServiceURL)
+}
+
+// 一个记录：某个服务的一个实例
+type Instance struct {
+	Name   ServiceName
+	ID     string
+	URL    string
+	Weight int // 加权负载均衡使用的权重
+}
+
+// 注册记录对应的补丁条目
+func entryOf(r Registration) Instance {
+	return Instance{Name: r.ServiceName, ID: r.ServiceID, URL: r.ServiceURL, Weight: r.Weight}
 }
 
 // 增加/删除记录
-type patch struct {
-	Added   []patchEntry
-	Removed []patchEntry
+type Patch struct {
+	Added    []Instance
+	Removed  []Instance
+	Full     bool   // Added 是依赖服务当前的完整实例列表，接收方用它替换整个缓存
+	Epoch    uint64 // 产生该补丁的纪元：集群模式为主节点的任期，单机模式为注册中心启动时生成的 ID；版本号只在同一纪元内可以比较
+	Revision uint64 // 注册中心产生该补丁时的版本
+	Previous uint64 // 上一个发给同一接收方的补丁的版本，接收方据此发现漏掉的补丁
 }
@@ -5,191 +5,770 @@ package registry
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
-	"os"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
-// 服务注册的ip和端口
-const ServerPort = ":3000"
-const ServicesURL = "http://localhost" + ServerPort + "/services" // 通过这个url可以查询到哪些服务？
-const registryFile = "./registry.json"
+// 默认的注册信息持久化文件
+const DefaultRegistryFile = "./registry.json"
 
 // 服务注册中心（相当于服务注册的表：记录1--服务1，记录2--服务2...）
 type registry struct {
 	registrations []Registration // 已经注册的服务（可能多个线程并发访问，并且是动态变化的，所以要确保并发安全性）
 	mutex         *sync.RWMutex    // 互斥锁
+	store         Storage          // 持久化存储，每个注册中心实例各自独立
+	pending       int              // 上次快照之后追加的事件数
+	leases        map[string]time.Time // 租约模式实例的过期时间
+	checkers      map[string]chan struct{} // 每个实例独立的心跳检查协程，关闭通道即停止
+	monitoring    bool                 // 是否已经开始心跳检查
+	raft          *raftNode            // 集群模式下的共识节点，单机模式为 nil
+	leading       bool                 // 是否由本节点维护租约、心跳检查和通知：单机模式始终为 true，集群模式下为主节点时为 true
+	epoch         uint64               // 版本号所属的纪元：单机模式为启动时生成的 ID，集群模式为作为主节点的任期
+	revision      uint64               // 可路由实例集合在本纪元内的版本，每次通知加一（只在本节点内存中递增）
+	history       []revisionEntry      // 最近的变化，客户端据此补齐漏掉的补丁
+	delivered     map[string]uint64    // 最后一次发给每个实例的补丁版本
+	changed       chan struct{}        // 每次通知时关闭并替换，唤醒等待变化的 watch 请求
+	reconciling   bool                 // 正在核对恢复的实例，期间的变化暂不通知
+	held          Patch                // 核对期间暂不通知的变化，核对完成后一起通知
+	done          chan struct{}        // Stop 时关闭
 }
 
-// 持久化注册信息到文件
-func (r *registry) saveToFile() error {
-    file, err := os.Create(registryFile)
-    if err != nil {
-        return err
-    }
-    defer file.Close()
+// 一个版本的变化
+type revisionEntry struct {
+	revision uint64
+	patch    Patch
+}
+
+// 保留最近多少个版本的变化
+const DefaultHistorySize = 1000
+
+// 创建一个空的服务表
+func newRegistry(store Storage) *registry {
+	return &registry{
+		registrations: make([]Registration, 0),
+		mutex:         new(sync.RWMutex),
+		store:         store,
+		leases:        make(map[string]time.Time),
+		checkers:      make(map[string]chan struct{}),
+		delivered:     make(map[string]uint64),
+		changed:       make(chan struct{}),
+		done:          make(chan struct{}),
+		epoch:         bootEpoch(),
+		leading:       true,
+	}
+}
+
+// 单机模式的纪元：注册中心每次启动生成一个新的随机 ID，版本号从 0 重新计数。
+// 纪元只比较是否相同，不依赖时钟，也不需要跨越重启保持递增；0 留给还没有同步过的客户端和不是主节点的集群节点
+func bootEpoch() uint64 {
+	for {
+		if id := rand.Uint64(); id != 0 {
+			return id
+		}
+	}
+}
+
+// 存储写入失败，由注册中心而不是请求方造成（返回 500）
+var errStorage = errors.New("registry storage failed")
 
-    encoder := json.NewEncoder(file)
-    return encoder.Encode(r.registrations)
+// 持久化一条事件，在修改服务表之前调用：写入失败时不修改，请求方得到的结果与实际状态一致；调用方需持有锁
+func (r *registry) persist(e Event) error {
+	err := r.appendEvent(e)
+	if err != nil {
+		return err
+	}
+	if r.raft == nil {
+		r.pending++
+	}
+	return nil
 }
 
-// 从文件中恢复注册信息
-func (r *registry) loadFromFile() error {
-    file, err := os.Open(registryFile)
-    if err != nil {
-        if os.IsNotExist(err) {
-            return nil
-        }
-        return err
-    }
-    defer file.Close()
+// 把事件追加到日志，不需要持有锁（存储自己保证并发安全）；持有锁时由 persist 调用。
+// 集群模式下服务表由 Raft 的日志和快照持久化，这里不再写入
+func (r *registry) appendEvent(e Event) error {
+	if r.raft != nil {
+		return nil
+	}
+	err := r.store.Append(e)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errStorage, err)
+	}
+	return nil
+}
 
-    decoder := json.NewDecoder(file)
-    return decoder.Decode(&r.registrations)
+// 修改服务表之后调用：事件日志足够长时写快照压缩日志。
+// 事件已经写入日志，快照失败不影响这次写操作，下一次再试；调用方需持有锁
+func (r *registry) compactLog() {
+	if r.pending < DefaultSnapshotEvery {
+		return
+	}
+	err := r.snapshot()
+	if err != nil {
+		log.Println(err)
+	}
 }
 
-// 向外提供的加载文件的接口
-func LoadFromFile() error {
-	return reg.loadFromFile()
+// 把当前的服务表写成快照；调用方需持有锁
+func (r *registry) snapshot() error {
+	err := r.store.SaveSnapshot(r.registrations)
+	if err != nil {
+		return err
+	}
+	r.pending = 0
+	return nil
 }
 
-// 注册方法
-func (r *registry) add(reg Registration) error {
-	// 加锁解锁 ，避免并发问题
+// 从存储中恢复注册信息：读取快照，重放之后的事件，然后写一个新的快照
+func (r *registry) load() error {
+	regs, events, err := r.store.Load()
+	if err != nil {
+		return err
+	}
 
 	r.mutex.Lock()
-	
-	// 增加服务记录到服务表
-	r.registrations = append(r.registrations, reg)
-
-	// 持久化注册信息
-    err := r.saveToFile()
-    if err != nil {
-        return err
-    }
-	// 1 对应 1
-	r.mutex.Unlock()
+	defer r.mutex.Unlock()
+	r.registrations = make([]Registration, 0, len(regs))
+	deadlines := make(map[string]time.Time)
+	put := func(reg Registration) {
+		if idx := r.indexOf(reg.ServiceID); idx >= 0 {
+			r.registrations[idx] = reg
+			return
+		}
+		r.registrations = append(r.registrations, reg)
+	}
 
-	// TODO(理解为什么要这一步，有什么作用？):注册服务后，发送所有依赖的服务
-	err = r.sendRequiredServices(reg)
-
-	//r.mutex.Unlock()	// 一旦这里才解锁，服务注册只能完成第一个，其他的服务不能再注册了 并且 server.go 退出后，其他的也会退出
-	// 总结：其实这里锁的位置只要保证：我在发送依赖信息的时候，确保没有写入 
-
-	r.notify(patch{
-		Added: []patchEntry{
-			{
-				Name: reg.ServiceName,
-				URL:  reg.ServiceURL,
-			},
-		},
-	})
-	
-	return err
+	// 旧版本的文件没有实例ID：按服务名和地址补上ID（每次启动都相同），同一个ID只保留最后一条
+	for _, reg := range regs {
+		if reg.ServiceID == "" {
+			reg.ServiceID = defaultServiceID(reg)
+		}
+		put(reg)
+	}
+	for _, e := range events {
+		switch e.Type {
+		case EventAdd:
+			put(e.Registration)
+			deadlines[e.Registration.ServiceID] = e.Expires
+		case EventRemove:
+			if k := r.indexOf(e.ID); k >= 0 {
+				r.registrations = append(r.registrations[:k], r.registrations[k+1:]...)
+			}
+			delete(deadlines, e.ID)
+		case EventLease:
+			deadlines[e.ID] = e.Expires
+		default:
+			log.Printf("Skipping unknown registry event %q", e.Type)
+		}
+	}
+
+	// 恢复的实例在 reconcile 重新检查之前状态未知，不路由
+	for i := range r.registrations {
+		r.registrations[i].Status = HealthUnknown
+	}
+
+	// 租约实例按记录的过期时间恢复；在注册中心停机期间到期的实例无法续约，
+	// 从启动时起重新获得一个完整的租约周期
+	now := time.Now()
+	for _, reg := range r.registrations {
+		if reg.LeaseTTL <= 0 {
+			continue
+		}
+		deadline := deadlines[reg.ServiceID]
+		if !deadline.After(now) {
+			deadline = now.Add(reg.LeaseTTL)
+		}
+		r.leases[reg.ServiceID] = deadline
+	}
+
+	// 重放完成后压缩日志
+	return r.snapshot()
 }
 
-func (r *registry) heartbeat(freq time.Duration) {
-	for {
-		var wg sync.WaitGroup
-		//wg.Add(len(r.registrations))	// 也可以放在外面，但是这里放在里面
-		for _, reg := range r.registrations {
-			wg.Add(1)
-			go func(reg Registration) {
-				defer wg.Done()
-				success := true
-				for attemps := 0; attemps < 3; attemps++ {
-					res, err := http.Get(reg.HeartbeatURL)
+// 启动时的核对：从存储恢复的实例状态为 unknown，在核对之前既不路由也不通知依赖方。
+// 并发地对每个实例检查一次心跳，能连通的记录检查结果，连不上的直接移除；
+// 租约实例没有心跳地址，第一次续约时恢复为 passing。
+// 核对期间的变化先不通知：全部核对完成后一起通知一次，再向每个实例推送一次完整的依赖列表，
+// 替换它们在注册中心重启前缓存的实例。依赖方不会在其他实例还没有核对时先收到部分实例
+func (r *registry) reconcile() {
+	r.mutex.Lock()
+	regs := append([]Registration(nil), r.registrations...)
+	r.reconciling = true
+	r.held = Patch{}
+	r.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, reg := range regs {
+		if reg.Status != HealthUnknown || reg.LeaseTTL > 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(reg Registration) {
+			defer wg.Done()
+			status := HealthPassing
+			if reg.HeartbeatURL != "" {
+				policy := reg.Heartbeat.withDefaults()
+				var err error
+				status, err = checkHealth(&http.Client{Timeout: policy.Timeout}, reg.HeartbeatURL)
+				if err != nil {
+					log.Printf("Removing restored instance %v: %v", reg.ServiceID, err)
+					_, err = r.commit(command{Op: opRemove, ID: reg.ServiceID})
 					if err != nil {
 						log.Println(err)
-					} else if res.StatusCode == http.StatusOK {
-						log.Printf("Heartbeat check passed for %v", reg.ServiceName)
-						if !success {
-							r.add(reg)
-						}
-						break
-					}
-					log.Printf("Heartbeat check failed for %v", reg.ServiceName)
-					if success {
-						success = false
-						r.remove(reg.ServiceURL)
 					}
-					time.Sleep(1 * time.Second)
+					return
 				}
-			}(reg)
+			}
+			_, err := r.commit(command{Op: opStatus, ID: reg.ServiceID, Status: status})
+			if err != nil {
+				log.Println(err)
+			}
+		}(reg)
+	}
+	wg.Wait()
+
+	r.mutex.Lock()
+	regs = append(regs[:0], r.registrations...)
+	r.reconciling = false
+	held := r.held
+	r.held = Patch{}
+	leading := r.leading
+	r.mutex.Unlock()
+	log.Printf("Reconciled %d restored registrations", len(regs))
+	if leading && (len(held.Added) > 0 || len(held.Removed) > 0) {
+		r.notify(held)
+	}
+	for _, reg := range regs {
+		go func(reg Registration) {
+			err := r.sendRequiredServices(reg)
+			if err != nil {
+				log.Println(err)
+			}
+		}(reg)
+	}
+}
+
+// 查找实例在服务表中的下标，调用方需持有锁
+func (r *registry) indexOf(id string) int {
+	for i := range r.registrations {
+		if r.registrations[i].ServiceID == id {
+			return i
 		}
-		wg.Wait()
-		time.Sleep(freq)
 	}
+	return -1
 }
-var once sync.Once
 
-// 这里使用 go 开启一个协程是为了不阻塞主线程，而心跳函数中的协程是为了能并发处理心跳检查
-func SetupRegistryService() {
-	once.Do(func() {
-		go reg.heartbeat(3 * time.Second)
-	})
+// 注册表的写操作。单机模式下直接应用；集群模式下先通过 Raft 复制到多数节点，
+// 再由每个节点按相同的顺序应用，每个节点都修改服务表，通知、心跳检查等副作用只由主节点在应用后执行。
+type command struct {
+	Op           string
+	Registration Registration // add
+	ID           string       // remove、status
+	Status       HealthStatus // status
 }
 
-// 发送服务状态更新通知
-func (r registry) notify(fullPatch patch) {
+const (
+	opNoop   = "noop" // 新的主节点提交的空操作，用于确认之前任期的日志
+	opAdd    = "add"
+	opRemove = "remove"
+	opStatus = "status"
+)
+
+// 写操作应用后的结果
+type applyResult struct {
+	old     Registration // 修改前的记录
+	existed bool         // 修改前记录是否存在
+	current Registration // 修改后的记录
+	err     error
+}
+
+// 应用一条写操作：先持久化再修改服务表，然后由主节点执行副作用
+func (r *registry) apply(cmd command) applyResult {
+	res := r.mutate(cmd)
+	if res.err == nil {
+		r.afterApply(cmd, res)
+	}
+	return res
+}
+
+// 修改服务表
+func (r *registry) mutate(cmd command) applyResult {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var res applyResult
+	switch cmd.Op {
+	case opAdd:
+		// 依赖关系不能有环，否则这些服务互相等待，都无法正常工作。
+		// 在应用时检查：与插入在同一把锁内，集群模式下每个节点按相同的顺序得到相同的结果
+		reg := cmd.Registration
+		if err := r.checkCycle(reg); err != nil {
+			res.err = err
+			return res
+		}
+		// 持久化注册信息
+		if err := r.persist(Event{Type: EventAdd, Registration: reg, Expires: leaseDeadline(reg)}); err != nil {
+			res.err = err
+			return res
+		}
+		// 增加服务记录到服务表，已存在的实例则原地更新
+		idx := r.indexOf(reg.ServiceID)
+		res.existed = idx >= 0
+		if res.existed {
+			res.old = r.registrations[idx]
+			r.registrations[idx] = reg
+		} else {
+			r.registrations = append(r.registrations, reg)
+		}
+		res.current = reg
+		r.compactLog()
+	case opRemove:
+		k := r.indexOf(cmd.ID)
+		if k < 0 {
+			res.err = fmt.Errorf("%w: %s", ErrNotRegistered, cmd.ID)
+			return res
+		}
+		if err := r.persist(Event{Type: EventRemove, ID: cmd.ID}); err != nil {
+			res.err = err
+			return res
+		}
+		res.existed = true
+		res.old = r.registrations[k]
+		r.registrations = append(r.registrations[:k], r.registrations[k+1:]...)
+		r.compactLog()
+	case opStatus:
+		k := r.indexOf(cmd.ID)
+		if k < 0 {
+			res.err = fmt.Errorf("%w: %s", ErrNotRegistered, cmd.ID)
+			return res
+		}
+		res.existed = true
+		res.old = r.registrations[k]
+		r.registrations[k].Status = cmd.Status
+		res.current = r.registrations[k]
+		// 健康状态变化频繁且可以重新检查得到，不需要持久化
+	}
+	return res
+}
+
+// 写操作应用之后的副作用，只在主节点（单机模式下就是本节点）执行：维护租约和心跳检查，
+// 可路由的实例集合变化时通知依赖方。由应用写操作的一方执行，而不是发起写操作的请求：
+// 集群模式下等待提交超时的写操作之后仍然可能被应用，副作用不会因此丢失
+func (r *registry) afterApply(cmd command, res applyResult) {
+	var p Patch
+	r.mutex.Lock()
+	if !r.leading {
+		r.mutex.Unlock()
+		return
+	}
+	switch cmd.Op {
+	case opAdd:
+		reg := res.current
+		// 租约模式：注册即获得一个租约
+		if reg.LeaseTTL > 0 {
+			r.leases[reg.ServiceID] = leaseDeadline(reg)
+		} else {
+			delete(r.leases, reg.ServiceID)
+		}
+		// 重新注册时检查策略可能变化，重新调度该实例的心跳检查
+		r.startChecker(reg)
+
+		// 只有可路由的实例集合发生变化（新实例、地址变化、健康状态变化）时才需要通知依赖方
+		old := res.old
+		changed := res.existed && (old.ServiceURL != reg.ServiceURL || old.ServiceName != reg.ServiceName)
+		wasRoutable := res.existed && old.routable()
+		if wasRoutable && (changed || !reg.routable()) {
+			p.Removed = append(p.Removed, entryOf(old))
+		}
+		if reg.routable() && (changed || !wasRoutable) {
+			p.Added = append(p.Added, entryOf(reg))
+		}
+	case opRemove:
+		// 停止该实例的租约和心跳检查
+		delete(r.leases, cmd.ID)
+		delete(r.delivered, cmd.ID)
+		r.stopChecker(cmd.ID)
+		// 不可路由的实例之前已经通知过移除
+		if res.old.routable() {
+			p.Removed = append(p.Removed, entryOf(res.old))
+		}
+	case opStatus:
+		old, reg := res.old, res.current
+		if old.routable() && !reg.routable() {
+			p.Removed = append(p.Removed, entryOf(reg))
+		}
+		if !old.routable() && reg.routable() {
+			p.Added = append(p.Added, entryOf(reg))
+		}
+	}
+	// 核对恢复的实例期间，变化先合并起来，核对完成后一起通知
+	if r.reconciling {
+		r.held = mergePatch(r.held, p)
+		p = Patch{}
+	}
+	r.mutex.Unlock()
+
+	if len(p.Added) > 0 || len(p.Removed) > 0 {
+		r.notify(p)
+	}
+}
+
+// 把 next 合并到 held 之后：同一个实例只保留最后一次变化
+func mergePatch(held, next Patch) Patch {
+	for _, inst := range next.Removed {
+		held.Added = removeInstance(held.Added, inst.ID)
+		held.Removed = append(removeInstance(held.Removed, inst.ID), inst)
+	}
+	for _, inst := range next.Added {
+		held.Removed = removeInstance(held.Removed, inst.ID)
+		held.Added = append(removeInstance(held.Added, inst.ID), inst)
+	}
+	return held
+}
+
+func removeInstance(list []Instance, id string) []Instance {
+	res := list[:0]
+	for _, inst := range list {
+		if inst.ID != id {
+			res = append(res, inst)
+		}
+	}
+	return res
+}
+
+// 当前的完整服务表，用于 Raft 的快照
+func (r *registry) state() []Registration {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
+	return append([]Registration(nil), r.registrations...)
+}
+
+// 用 Raft 快照中的服务表替换当前的服务表：节点启动时，或者跟随者落后太多、由主节点发来快照时
+func (r *registry) restore(regs []Registration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.registrations = append(make([]Registration, 0, len(regs)), regs...)
+}
+
+// 注册时租约的过期时间，非租约模式为零值
+func leaseDeadline(reg Registration) time.Time {
+	if reg.LeaseTTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(reg.LeaseTTL)
+}
+
+// 提交写操作：单机模式直接应用，集群模式由 Raft 复制并等待应用完成
+func (r *registry) commit(cmd command) (applyResult, error) {
+	if r.raft == nil {
+		res := r.apply(cmd)
+		return res, res.err
+	}
+	return r.raft.propose(cmd)
+}
+
+// 注册方法：同一个 ServiceID 重复注册时更新已有记录而不是追加（幂等），返回最终保存的注册记录
+func (r *registry) add(reg Registration) (Registration, error) {
+	// 没有携带实例ID时由注册中心按服务名和地址生成，同一地址重复注册时更新同一条记录
+	if reg.ServiceID == "" {
+		reg.ServiceID = defaultServiceID(reg)
+	}
+	// 刚注册的实例能发出注册请求，认为它是正常的，后续由心跳检查更新状态
+	if reg.Status == "" {
+		reg.Status = HealthPassing
+	}
+
+	// 租约、心跳检查和通知由 afterApply 在应用时处理
+	_, err := r.commit(command{Op: opAdd, Registration: reg})
+	if err != nil {
+		return reg, err
+	}
+
+	// TODO(理解为什么要这一步，有什么作用？):注册服务后，发送所有依赖的服务
+	// 发送失败不影响注册：实例可能还没有开始接收补丁（例如刚重启），下一个补丁到达时由版本号发现漏掉的列表并补齐
+	if err := r.sendRequiredServices(reg); err != nil {
+		log.Printf("Failed to send required services to %s: %v", reg.ServiceID, err)
+	}
+	return reg, nil
+}
+
+// 续约：把实例的租约延长一个 TTL。
+// 先持久化续约事件，写入成功后才延长内存中的租约；续约很频繁，写入磁盘时不持有锁，不阻塞查询
+func (r *registry) renew(id string) error {
+	r.mutex.RLock()
+	k := r.indexOf(id)
+	if k < 0 {
+		r.mutex.RUnlock()
+		return fmt.Errorf("%w: %s", ErrNotRegistered, id)
+	}
+	ttl := r.registrations[k].LeaseTTL
+	r.mutex.RUnlock()
+	if ttl <= 0 {
+		return fmt.Errorf("service instance %s is not registered with a lease", id)
+	}
+
+	deadline := time.Now().Add(ttl)
+	err := r.appendEvent(Event{Type: EventLease, ID: id, Expires: deadline})
+	if err != nil {
+		return err
+	}
 
+	r.mutex.Lock()
+	// 写入期间实例可能已经被移除（取消注册、租约过期），这条事件重放时会被忽略
+	k = r.indexOf(id)
+	if k < 0 {
+		r.mutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrNotRegistered, id)
+	}
+	r.leases[id] = deadline
+	if r.raft == nil {
+		r.pending++
+		r.compactLog()
+	}
+	unknown := r.registrations[k].Status == HealthUnknown
+	r.mutex.Unlock()
+
+	// 恢复的租约实例能够续约，说明它还活着
+	if unknown {
+		r.setStatus(id, HealthPassing)
+	}
+	return nil
+}
+
+// 定期清理租约过期的实例，并向依赖方发送 Removed 补丁
+func (r *registry) expireLeases(freq time.Duration) {
+	for {
+		select {
+		case <-time.After(freq):
+		case <-r.done:
+			return
+		}
+
+		// 集群模式下只有主节点清理过期租约
+		if r.raft != nil {
+			if _, isLeader := r.raft.leader(); !isLeader {
+				continue
+			}
+		}
+
+		var expired []string
+		now := time.Now()
+		r.mutex.RLock()
+		for id, deadline := range r.leases {
+			if now.After(deadline) {
+				expired = append(expired, id)
+			}
+		}
+		r.mutex.RUnlock()
+
+		for _, id := range expired {
+			log.Printf("Lease expired for %s", id)
+			err := r.remove(id)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// 记录心跳检查得到的健康状态；实例在可路由与不可路由之间切换时通知依赖方
+func (r *registry) setStatus(id string, status HealthStatus) {
+	// 状态没有变化时不需要提交
+	r.mutex.RLock()
+	k := r.indexOf(id)
+	unchanged := k < 0 || r.registrations[k].Status == status
+	r.mutex.RUnlock()
+	if unchanged {
+		return
+	}
+
+	_, err := r.commit(command{Op: opStatus, ID: id, Status: status})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// 按条件查询注册记录：name 为空表示不限服务名，healthyOnly 表示只返回健康状态为 passing 的服务
+func (r *registry) find(name ServiceName, healthyOnly bool) []Registration {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	result := make([]Registration, 0)
 	for _, reg := range r.registrations {
-		go func(reg Registration) {
-			for _, reqService := range reg.RequiredServices {
-				// 遍历 该服务的所有需要的服务
-				// 为每个依赖服务初始化一个补丁p，并设置一个标志sendUpdate来决定是否需要发送更新。
-				p := patch{Added: []patchEntry{}, Removed: []patchEntry{}}
-				sendUpdate := false
-				// 遍历fullPatch中的所有新增服务条目，如果当前服务需要该新增服务，则将其添加到补丁p中，并设置更新标志。
-				for _, added := range fullPatch.Added {
-					if added.Name == reqService {
-						p.Added = append(p.Added, added)
-						sendUpdate = true
-					}
-				}
-				// 遍历fullPatch中的所有删除服务条目，如果当前服务需要该删除服务，则将其添加到补丁p中，并设置更新标志。
-				for _, removed := range fullPatch.Removed {
-					if removed.Name == reqService {
-						p.Removed = append(p.Removed, removed)
-						sendUpdate = true
-					}
-				}
-				// 如果需要发送更新，则调用sendPatch方法发送补丁p到当前服务的更新URL。
-				if sendUpdate {
-					err := r.sendPatch(p, reg.ServiceUpdateURL)
-					if err != nil {
-						log.Println(err)
-						return
-					}
-				}
+		if name != "" && reg.ServiceName != name {
+			continue
+		}
+		if healthyOnly && !reg.routable() {
+			continue
+		}
+		result = append(result, reg)
+	}
+	return result
+}
+
+// 发送服务状态更新通知：每次通知都产生一个新的版本，并记录到历史中。
+// 每个服务只收到它依赖的服务的变化，补丁的 Previous 为上一次发给它的版本。
+func (r *registry) notify(fullPatch Patch) {
+	r.mutex.Lock()
+	r.revision++
+	rev := r.revision
+	r.history = append(r.history, revisionEntry{revision: rev, patch: fullPatch})
+	if len(r.history) > DefaultHistorySize {
+		r.history = append(r.history[:0], r.history[len(r.history)-DefaultHistorySize:]...)
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+
+	type delivery struct {
+		url string
+		p   Patch
+	}
+	var deliveries []delivery
+	for _, reg := range r.registrations {
+		// 没有提供更新地址、或者没有声明依赖的服务不接收推送
+		if reg.ServiceUpdateURL == "" || len(reg.RequiredServices) == 0 {
+			continue
+		}
+		// 只保留该服务依赖的服务的变化，没有相关变化时不发送
+		p := filterPatch(fullPatch, reg.RequiredServices)
+		if len(p.Added) == 0 && len(p.Removed) == 0 {
+			continue
+		}
+		p.Epoch = r.epoch
+		p.Revision = rev
+		p.Previous = r.delivered[reg.ServiceID]
+		r.delivered[reg.ServiceID] = rev
+		deliveries = append(deliveries, delivery{url: reg.ServiceUpdateURL, p: p})
+	}
+	r.mutex.Unlock()
+
+	for _, d := range deliveries {
+		go func(d delivery) {
+			err := r.sendPatch(d.p, d.url)
+			if err != nil {
+				log.Println(err)
 			}
-		}(reg)
+		}(d)
 	}
 }
 
-// 发送依赖的服务
-func (r registry) sendRequiredServices(reg Registration) error {
-	// 1 对应 1 发送一个服务的依赖服务
+// 只保留 names 中的服务的变化，names 为空时保留全部（用于 ?since= 和 watch 查询，推送时不会传入空的 names）
+func filterPatch(p Patch, names []ServiceName) Patch {
+	if len(names) == 0 {
+		return Patch{Added: p.Added, Removed: p.Removed}
+	}
+	res := Patch{Added: []Instance{}, Removed: []Instance{}}
+	for _, name := range names {
+		for _, added := range p.Added {
+			if added.Name == name {
+				res.Added = append(res.Added, added)
+			}
+		}
+		for _, removed := range p.Removed {
+			if removed.Name == name {
+				res.Removed = append(res.Removed, removed)
+			}
+		}
+	}
+	return res
+}
+
+// 纪元 epoch 中的版本 since 之后 names 中的服务发生的变化。
+// 历史中还保留着 since 之后的全部变化时返回合并后的增量，否则（纪元不同，例如来自重启前的注册中心或者之前的主节点，或者版本太旧）返回完整的实例列表。
+func (r *registry) changesSince(epoch, since uint64, names []ServiceName) Patch {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	var p patch
+	covered := epoch == r.epoch && (since == r.revision ||
+		(since < r.revision && len(r.history) > 0 && r.history[0].revision <= since+1))
+	if !covered {
+		p := Patch{Added: []Instance{}, Full: true, Epoch: r.epoch, Revision: r.revision}
+		for _, reg := range r.registrations {
+			if reg.routable() && (len(names) == 0 || containsName(names, reg.ServiceName)) {
+				p.Added = append(p.Added, entryOf(reg))
+			}
+		}
+		return p
+	}
+
+	// 按顺序合并：同一个实例只保留最后一次变化
+	latest := make(map[string]bool) // 实例ID -> 最后一次是否为新增
+	var order []Instance
+	seen := make(map[string]int)
+	record := func(inst Instance, added bool) {
+		if i, ok := seen[inst.ID]; ok {
+			order[i] = inst
+		} else {
+			seen[inst.ID] = len(order)
+			order = append(order, inst)
+		}
+		latest[inst.ID] = added
+	}
+	for _, entry := range r.history {
+		if entry.revision <= since {
+			continue
+		}
+		p := filterPatch(entry.patch, names)
+		for _, inst := range p.Removed {
+			record(inst, false)
+		}
+		for _, inst := range p.Added {
+			record(inst, true)
+		}
+	}
+	p := Patch{Added: []Instance{}, Removed: []Instance{}, Epoch: r.epoch, Revision: r.revision, Previous: since}
+	for _, inst := range order {
+		if latest[inst.ID] {
+			p.Added = append(p.Added, inst)
+		} else {
+			p.Removed = append(p.Removed, inst)
+		}
+	}
+	return p
+}
+
+func containsName(names []ServiceName, name ServiceName) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 发送依赖的服务。发送失败时仍然记录发给该服务的版本：下一个补丁的 Previous 大于服务已同步的版本，
+// 服务据此向注册中心补齐，所以调用方只需要记录错误
+func (r *registry) sendRequiredServices(reg Registration) error {
+	// 没有依赖的服务不需要实例列表
+	if reg.ServiceUpdateURL == "" || len(reg.RequiredServices) == 0 {
+		return nil
+	}
+	// 1 对应 1 发送一个服务的依赖服务；写锁：同时记录发给该服务的版本
+	r.mutex.Lock()
+
+	// 发送的是完整的依赖列表，服务用它替换缓存
+	p := Patch{Full: true, Epoch: r.epoch, Revision: r.revision}
 	for _, serviceReg := range r.registrations {
 		// 遍历服务注册表
 		for _, reqService := range reg.RequiredServices {
 			// 遍历该 服务 依赖的服务
-			if serviceReg.ServiceName == reqService {
-				// 注册表中有需要的依赖服务，将服务挂载到添加条目中
-				p.Added = append(p.Added, patchEntry{serviceReg.ServiceName, serviceReg.ServiceURL})
+			if serviceReg.ServiceName == reqService && serviceReg.routable() {
+				// 注册表中有需要的（并且健康的）依赖服务，将服务挂载到添加条目中
+				p.Added = append(p.Added, entryOf(serviceReg))
 			}
 		}
 	}
+	r.delivered[reg.ServiceID] = r.revision
+	r.mutex.Unlock()
+
 	err := r.sendPatch(p, reg.ServiceUpdateURL)
 	if err != nil {
 		return err
@@ -197,49 +776,197 @@ func (r registry) sendRequiredServices(reg Registration) error {
 	return nil
 }
 
-// 发送 服务依赖关系 的变动
-func (r registry) sendPatch(p patch, url string) error {
+// 发送 服务依赖关系 的变动；服务没有返回 200 时也算发送失败
+func (r *registry) sendPatch(p Patch, url string) error {
 	d, err := json.Marshal(p)
 	if err != nil {
 		return err
 	}
-	_, err = http.Post(url, "application/json", bytes.NewBuffer(d))
+	res, err := http.Post(url, "application/json", bytes.NewBuffer(d))
 	if err != nil {
 		return err
 	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v responded with code %v", url, res.StatusCode)
+	}
 	return nil
 }
 
-// 取消注册的方法
-func (r *registry) remove(url string) error {
-	// 遍历注册表中有没有服务地址，有则删除
-	for k := range r.registrations {
-		if r.registrations[k].ServiceURL == url {
-			r.notify(patch{Removed: []patchEntry{{r.registrations[k].ServiceName, r.registrations[k].ServiceURL}}},)
-			// 并发安全、删除对应url的访问地址
-			r.mutex.Lock()
-			r.registrations = append(r.registrations[:k], r.registrations[k+1:]...)
-			r.mutex.Unlock()
-			return nil
+// 实例不存在（从未注册、已取消注册或租约已过期）
+var ErrNotRegistered = errors.New("service instance not registered")
+
+// 取消注册的方法：按实例ID删除，租约、心跳检查和通知由 afterApply 处理
+func (r *registry) remove(id string) error {
+	_, err := r.commit(command{Op: opRemove, ID: id})
+	return err
+}
+
+// 主节点变化：成为主节点时接管心跳检查和租约，不再是主节点时全部停止
+func (r *registry) leadershipChanged(isLeader bool, term uint64) {
+	if !isLeader {
+		r.stopHealthChecks()
+		r.mutex.Lock()
+		r.leading = false
+		r.leases = make(map[string]time.Time)
+		r.mutex.Unlock()
+		return
+	}
+
+	// 租约只保存在主节点内存中，新的主节点给所有租约实例一个完整的租约周期；
+	// 之后应用的写操作由 afterApply 维护租约
+	r.mutex.Lock()
+	r.leading = true
+	now := time.Now()
+	for _, reg := range r.registrations {
+		if reg.LeaseTTL > 0 {
+			r.leases[reg.ServiceID] = now.Add(reg.LeaseTTL)
 		}
 	}
-	return fmt.Errorf("service at URL %s not found",url)
+	// 之前的主节点发出的版本在这里没有历史：以任期为新的纪元，版本重新计数。
+	// 任期在集群内单调递增，不依赖各个节点的时钟
+	r.epoch = term
+	r.revision = 0
+	r.history = nil
+	r.delivered = make(map[string]uint64)
+	r.mutex.Unlock()
+	r.reconcile()
+	r.startHealthChecks()
+}
+
+// 定义 注册服务的实现逻辑（handler），每个实例拥有独立的服务表，可以在同一进程中并存
+type RegistryService struct {
+	reg      *registry
+	once     sync.Once
+	stopOnce sync.Once
+}
+
+// 创建注册服务，file 为注册信息的快照文件，事件日志保存在 file + ".wal"
+func NewRegistryService(file string) *RegistryService {
+	return NewRegistryServiceWithStorage(NewFileStorage(file))
+}
+
+// 使用指定的存储后端创建注册服务，例如测试中使用 NewMemoryStorage
+func NewRegistryServiceWithStorage(store Storage) *RegistryService {
+	return &RegistryService{reg: newRegistry(store)}
+}
+
+// 创建集群模式的注册服务：self 为本节点的访问地址（如 http://localhost:3001），peers 为其他节点的地址。
+// 注册表通过 Raft 在节点之间复制，只有主节点接受写请求、执行心跳检查和发送通知。
+func NewClusterRegistryService(store Storage, self string, peers []string) *RegistryService {
+	s := NewRegistryServiceWithStorage(store)
+	rs, ok := store.(raftStorage)
+	if !ok {
+		log.Printf("Storage %T does not persist raft state, the node keeps its log in memory only", store)
+	}
+	s.reg.leading = false
+	s.reg.epoch = 0
+	s.reg.raft = newRaftNode(self, peers, rs, s.reg)
+	return s
+}
+
+// 把注册中心的路由挂载到 mux 上：/services、/services/...，集群模式下还有节点之间通信的 /raft/
+func (s *RegistryService) RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("/services", s)
+	mux.Handle("/services/", s)
+	if s.reg.raft != nil {
+		mux.Handle("/raft/", s.reg.raft)
+	}
+}
+
+// 集群节点之间通信的处理程序，需要挂载到 /raft/ 路径；单机模式返回 nil
+func (s *RegistryService) RaftHandler() http.Handler {
+	if s.reg.raft == nil {
+		return nil
+	}
+	return s.reg.raft
 }
 
-// 定义服务表结构（服务数0，互斥锁）
-var reg = registry{
-	registrations: make([]Registration, 0),
-	mutex:         new(sync.RWMutex),
+// 加载之前保存的注册信息：单机模式为快照 + 事件日志；集群模式下服务表只由 Raft 的快照和日志恢复，
+// 不读取单机模式的文件，否则节点会带着其他节点没有的注册记录启动
+func (s *RegistryService) LoadFromFile() error {
+	if s.reg.raft != nil {
+		return s.reg.raft.load()
+	}
+	return s.reg.load()
 }
 
-// 定义 注册服务的实现逻辑（handler）
-type RegistryService struct{}
+// 先核对从存储恢复的实例（最多等待一个心跳超时），再开始心跳检查：每个实例在自己的协程中按各自的策略检查，互不阻塞
+func (s *RegistryService) Setup() {
+	s.once.Do(func() {
+		// 集群模式下成为主节点后才开始心跳检查
+		if s.reg.raft == nil {
+			s.reg.reconcile()
+			s.reg.startHealthChecks()
+		} else {
+			s.reg.raft.start()
+		}
+		go s.reg.expireLeases(1 * time.Second)
+	})
+}
+
+// 停止心跳检查和租约清理，集群模式下节点退出集群（不再参加选举和复制）；之后不能再次启动
+func (s *RegistryService) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.reg.done)
+		if s.reg.raft != nil {
+			s.reg.raft.stop()
+		}
+		s.reg.stopHealthChecks()
+	})
+}
 
 // 实现 ServerHttp 方法
-func (s RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (s *RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("Request received")
+	// /services/{id}/lease：续约
+	pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathSegments) == 3 && pathSegments[2] == "lease" {
+		if s.redirectToLeader(w, r) {
+			return
+		}
+		s.renewLease(w, r, pathSegments[1])
+		return
+	}
+	// /services/watch：长轮询关注服务的变化
+	if len(pathSegments) == 2 && pathSegments[1] == "watch" {
+		s.watch(w, r)
+		return
+	}
+	// /services/graph：依赖图
+	if len(pathSegments) == 2 && pathSegments[1] == "graph" {
+		s.serveGraph(w, r)
+		return
+	}
+	if len(pathSegments) > 1 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// 集群模式下写请求由主节点处理
+	if s.redirectToLeader(w, r) {
+		return
+	}
 	// 根据请求类型，进行不同处理逻辑
 	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		// 查询某个纪元中的版本之后的变化：/services?epoch=3&since=12&name=GradingService&name=LogService
+		if query.Has("since") {
+			s.serveChanges(w, query)
+			return
+		}
+		// 查询已注册的服务：/services?name=GradingService&healthy=true
+		healthyOnly, err := parseBoolQuery(query.Get("healthy"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		regs := s.reg.find(ServiceName(query.Get("name")), healthyOnly)
+		w.Header().Add("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(regs)
+		if err != nil {
+			log.Println(err)
+		}
 	case http.MethodPost:
 		dec := json.NewDecoder(r.Body)
 		var r Registration
@@ -249,25 +976,51 @@ func (s RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		log.Printf("Adding service: %v with URL: %s\n", r.ServiceName, r.ServiceURL)
-		err = reg.add(r)
-		if err != nil {
+		log.Printf("Adding service: %v (%s) with URL: %s\n", r.ServiceName, r.ServiceID, r.ServiceURL)
+		r, err = s.reg.add(r)
+		if errors.Is(err, errNotLeader) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// 依赖形成环是请求的问题，其他错误（例如存储写入失败）是注册中心的问题
+		if errors.Is(err, ErrDependencyCycle) {
 			log.Println(err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// 返回保存的注册记录，调用方可以从中得到注册中心生成的实例ID
+		w.Header().Add("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(r)
+		if err != nil {
+			log.Println(err)
+		}
 	case http.MethodDelete: 
+		// 请求体为要取消注册的实例ID
 		payload, err := io.ReadAll(r.Body)
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		url := string(payload)
-		log.Printf("Deleting service at URL: %s\n", url)
-		err = reg.remove(url)
+		id := string(payload)
+		log.Printf("Deleting service instance: %s\n", id)
+		err = s.reg.remove(id)
+		if errors.Is(err, ErrNotRegistered) {
+			log.Println(err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errNotLeader) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -276,3 +1029,84 @@ func (s RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// 返回纪元 epoch 中的版本 since 之后的变化（增量，或者完整的实例列表）；没有 epoch 参数时返回完整的实例列表
+func (s *RegistryService) serveChanges(w http.ResponseWriter, query url.Values) {
+	epoch, since, err := parseCursor(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var names []ServiceName
+	for _, name := range query["name"] {
+		names = append(names, ServiceName(name))
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(s.reg.changesSince(epoch, since, names))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// 集群模式下，非主节点把写请求重定向（307，保留请求方法和请求体）到主节点；还没有主节点时返回 503。
+// 普通的查询请求由本节点直接处理；?since= 查询依赖版本号和变化历史，只有主节点有，同样重定向。
+func (s *RegistryService) redirectToLeader(w http.ResponseWriter, r *http.Request) bool {
+	if s.reg.raft == nil || (r.Method == http.MethodGet && !r.URL.Query().Has("since")) {
+		return false
+	}
+	leader, isLeader := s.reg.raft.leader()
+	if isLeader {
+		return false
+	}
+	if leader == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	}
+	http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
+
+// 处理续约请求
+func (s *RegistryService) renewLease(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	err := s.reg.renew(id)
+	if errors.Is(err, ErrNotRegistered) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errStorage) {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+// 解析查询参数中的 epoch 和 since，缺省为 0
+func parseCursor(query url.Values) (epoch, since uint64, err error) {
+	if v := query.Get("epoch"); v != "" {
+		epoch, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if v := query.Get("since"); v != "" {
+		since, err = strconv.ParseUint(v, 10, 64)
+	}
+	return epoch, since, err
+}
+
+// 解析查询参数中的布尔值，空字符串视为 false
+func parseBoolQuery(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
@@ -0,0 +1,208 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 追加事件总是失败的存储
+type failingStorage struct {
+	Storage
+}
+
+func (failingStorage) Append(Event) error {
+	return errors.New("disk full")
+}
+
+func TestAddFailsWithoutChangesWhenStorageFails(t *testing.T) {
+	s := NewRegistryServiceWithStorage(failingStorage{NewMemoryStorage()})
+	data, err := json.Marshal(Registration{ServiceName: "StorageFails", ServiceURL: "http://localhost:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/services", bytes.NewReader(data)))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("registration responded with code %v, want 500", rec.Code)
+	}
+	if regs := s.reg.find("", false); len(regs) != 0 {
+		t.Errorf("failed registration is live: %v", regs)
+	}
+}
+
+// 租约由应用写操作的主节点维护：提交的一方超时返回之后写操作仍可能被应用，租约不能依赖 add 设置
+func TestApplyManagesLeasesOnlyWhenLeading(t *testing.T) {
+	r := newRegistry(NewMemoryStorage())
+	reg := Registration{ServiceID: "lease-1", ServiceName: "Lease", ServiceURL: "http://localhost:1", LeaseTTL: time.Minute, Status: HealthPassing}
+
+	r.leading = false
+	if res := r.apply(command{Op: opAdd, Registration: reg}); res.err != nil {
+		t.Fatal(res.err)
+	}
+	if _, ok := r.leases[reg.ServiceID]; ok {
+		t.Error("follower started a lease")
+	}
+
+	r.leading = true
+	if res := r.apply(command{Op: opAdd, Registration: reg}); res.err != nil {
+		t.Fatal(res.err)
+	}
+	if _, ok := r.leases[reg.ServiceID]; !ok {
+		t.Error("applied registration has no lease on the leader")
+	}
+	if res := r.apply(command{Op: opRemove, ID: reg.ServiceID}); res.err != nil {
+		t.Fatal(res.err)
+	}
+	if _, ok := r.leases[reg.ServiceID]; ok {
+		t.Error("removed instance still has a lease")
+	}
+}
+
+func TestRenewKeepsLeaseWhenStorageFails(t *testing.T) {
+	r := newRegistry(NewMemoryStorage())
+	reg := Registration{ServiceID: "renew-1", ServiceName: "Renew", ServiceURL: "http://localhost:1", LeaseTTL: time.Minute, Status: HealthPassing}
+	if res := r.apply(command{Op: opAdd, Registration: reg}); res.err != nil {
+		t.Fatal(res.err)
+	}
+	before := r.leases[reg.ServiceID]
+
+	r.store = failingStorage{r.store}
+	time.Sleep(time.Millisecond)
+	err := r.renew(reg.ServiceID)
+	if !errors.Is(err, errStorage) {
+		t.Fatalf("renew returned %v, want a storage error", err)
+	}
+	if got := r.leases[reg.ServiceID]; !got.Equal(before) {
+		t.Errorf("failed renewal extended the lease from %v to %v", before, got)
+	}
+}
+
+func TestReconcileHoldsPatchesUntilAllInstancesAreChecked(t *testing.T) {
+	var mutex sync.Mutex
+	var received []Patch
+	dependent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p Patch
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		received = append(received, p)
+		mutex.Unlock()
+	}))
+	t.Cleanup(dependent.Close)
+	receivedCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(received)
+	}
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(fast.Close)
+	// 慢的实例回应心跳时，快的实例早已核对完成，但依赖方还不应该收到任何补丁
+	var early atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		early.Store(int32(receivedCount()))
+	}))
+	t.Cleanup(slow.Close)
+
+	const name = ServiceName("Reconciled")
+	store := NewMemoryStorage()
+	err := store.SaveSnapshot([]Registration{
+		{ServiceName: "Dependent", ServiceID: "dependent", ServiceURL: dependent.URL, ServiceUpdateURL: dependent.URL, RequiredServices: []ServiceName{name}},
+		{ServiceName: name, ServiceID: "fast", ServiceURL: fast.URL, HeartbeatURL: fast.URL},
+		{ServiceName: name, ServiceID: "slow", ServiceURL: slow.URL, HeartbeatURL: slow.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRegistry(store)
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	r.reconcile()
+	if n := early.Load(); n != 0 {
+		t.Errorf("dependent received %d patches before reconciliation finished", n)
+	}
+
+	// 之后依赖方收到两个实例：一起通知的增量和完整列表
+	deadline := time.Now().Add(5 * time.Second)
+	for receivedCount() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("dependent received %d patches, want 2: %+v", len(received), received)
+	}
+	for _, p := range received {
+		if len(p.Added) != 2 || len(p.Removed) != 0 {
+			t.Errorf("patch does not announce both reconciled instances: %+v", p)
+		}
+	}
+}
+
+func TestRegisterReplacesAndDeregisterRemovesByServiceID(t *testing.T) {
+	s := NewRegistryServiceWithStorage(NewMemoryStorage())
+	t.Cleanup(s.Stop)
+	send := func(method string, body []byte) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(method, "/services", bytes.NewReader(body)))
+		return rec.Code
+	}
+	register := func(reg Registration) {
+		t.Helper()
+		data, err := json.Marshal(reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := send(http.MethodPost, data); code != http.StatusOK {
+			t.Fatalf("registration of %s responded with code %v", reg.ServiceID, code)
+		}
+	}
+	instances := func() map[string]Registration {
+		m := make(map[string]Registration)
+		for _, reg := range s.reg.find("Replace", false) {
+			if _, ok := m[reg.ServiceID]; ok {
+				t.Errorf("%s is registered more than once", reg.ServiceID)
+			}
+			m[reg.ServiceID] = reg
+		}
+		return m
+	}
+
+	register(Registration{ServiceID: "replace-1", ServiceName: "Replace", ServiceURL: "http://localhost:1"})
+	register(Registration{ServiceID: "replace-2", ServiceName: "Replace", ServiceURL: "http://localhost:2"})
+	// 同一个实例ID再次注册：替换原来的记录，而不是再追加一条
+	register(Registration{ServiceID: "replace-1", ServiceName: "Replace", ServiceURL: "http://localhost:3"})
+	got := instances()
+	if len(got) != 2 || got["replace-1"].ServiceURL != "http://localhost:3" {
+		t.Fatalf("registrations after re-registering: %v", got)
+	}
+	// 没有实例ID时按服务名和地址生成，同一地址重复注册也只有一条
+	register(Registration{ServiceName: "Replace", ServiceURL: "http://localhost:4"})
+	register(Registration{ServiceName: "Replace", ServiceURL: "http://localhost:4"})
+	if got := instances(); len(got) != 3 {
+		t.Fatalf("registrations after registering the same address twice: %v", got)
+	}
+
+	// 按实例ID取消注册，只移除这一条
+	if code := send(http.MethodDelete, []byte("replace-1")); code != http.StatusOK {
+		t.Fatalf("deregistration responded with code %v", code)
+	}
+	got = instances()
+	if _, ok := got["replace-1"]; ok || len(got) != 2 {
+		t.Fatalf("registrations after deregistering replace-1: %v", got)
+	}
+	if code := send(http.MethodDelete, []byte("replace-1")); code != http.StatusNotFound {
+		t.Errorf("deregistering an unknown ID responded with code %v, want 404", code)
+	}
+}
@@ -0,0 +1,390 @@
+package registry
+
+// 注册表的持久化：追加写的事件日志（WAL）加定期压缩的快照。
+// 每次写操作只在日志末尾追加一条事件，日志达到一定长度后把完整的注册表写成快照并清空日志；
+// 启动时先读取快照，再按顺序重放快照之后的事件。
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventAdd    = EventType("add")    // 注册或更新实例
+	EventRemove = EventType("remove") // 取消注册（包括租约过期、心跳检查失败）
+	EventLease  = EventType("lease")  // 续约
+)
+
+// 事件日志中的一条记录
+type Event struct {
+	Type         EventType
+	Registration Registration // add
+	ID           string       // remove、lease
+	Expires      time.Time    // 租约的过期时间（租约模式的 add、lease）
+}
+
+// 注册表的存储后端
+type Storage interface {
+	// 追加一条事件，返回时事件已经持久化
+	Append(e Event) error
+	// 写入完整的注册表作为快照，成功后清空事件日志
+	SaveSnapshot(regs []Registration) error
+	// 读取最近的快照以及快照之后的事件
+	Load() ([]Registration, []Event, error)
+}
+
+// 事件日志超过多少条时写一次快照
+const DefaultSnapshotEvery = 100
+
+// 文件存储：快照保存在 file（与旧版本的 registry.json 格式相同，可以直接读取），
+// 事件日志保存在 file + ".wal"，每行一条 JSON 事件
+type fileStorage struct {
+	mutex    sync.Mutex
+	snapshot string
+	walPath  string
+	wal      *os.File
+}
+
+func NewFileStorage(file string) Storage {
+	return &fileStorage{snapshot: file, walPath: file + ".wal"}
+}
+
+func (s *fileStorage) Append(e Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.wal == nil {
+		f, err := os.OpenFile(s.walPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.wal = f
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.wal.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// 先写临时文件并同步到磁盘，再原子地重命名为快照文件，写到一半崩溃也不会破坏已有的快照。
+// 重命名之后、清空日志之前崩溃时，重放的事件会再应用一次，事件是幂等的，结果不变。
+func (s *fileStorage) SaveSnapshot(regs []Registration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := writeJSONFile(s.snapshot, func(enc *json.Encoder) error {
+		return enc.Encode(regs)
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.wal != nil {
+		s.wal.Close()
+		s.wal = nil
+	}
+	err = os.Truncate(s.walPath, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileStorage) Load() ([]Registration, []Event, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var regs []Registration
+	data, err := os.ReadFile(s.snapshot)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, &regs)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	f, err := os.Open(s.walPath)
+	if os.IsNotExist(err) {
+		return regs, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	events, err := readEvents(f)
+	return regs, events, err
+}
+
+// 逐行读取事件。最后一行不完整说明追加时发生了崩溃，这条事件没有写成功，丢弃即可
+func readEvents(r io.Reader) ([]Event, error) {
+	var events []Event
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var e Event
+			if jerr := json.Unmarshal(line, &e); jerr != nil {
+				if err == io.EOF {
+					log.Printf("Discarding incomplete registry log entry: %q", line)
+					return events, nil
+				}
+				return nil, jerr
+			}
+			events = append(events, e)
+		}
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// 内存存储：不落盘，用于测试或者不需要持久化的场景。同一个存储可以交给重新创建的集群节点，模拟节点重启
+type memoryStorage struct {
+	mutex    sync.Mutex
+	regs     []Registration
+	events   []Event
+	raft     raftHardState
+	raftSnap raftSnapshot
+	raftLog  []raftEntry // 快照之后的条目
+}
+
+func NewMemoryStorage() Storage {
+	return &memoryStorage{}
+}
+
+func (s *memoryStorage) Append(e Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *memoryStorage) SaveSnapshot(regs []Registration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.regs = append([]Registration(nil), regs...)
+	s.events = nil
+	return nil
+}
+
+func (s *memoryStorage) Load() ([]Registration, []Event, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Registration(nil), s.regs...), append([]Event(nil), s.events...), nil
+}
+
+// Raft 的状态保存在 file + ".raft"，每次整体替换；日志保存在 file + ".raftlog"，
+// 每行一个带下标的条目，读取时下标不大于已读条目数的行截断之前的日志（被新的主节点覆盖）。
+// 快照保存在 file + ".raftsnap"，包含快照位置和当时的完整服务表，写入后日志文件只保留快照之后的条目
+type raftHardState struct {
+	Term     uint64
+	VotedFor string
+}
+
+type raftLogLine struct {
+	Index uint64
+	Entry raftEntry
+}
+
+// 先写临时文件并同步到磁盘，再原子地重命名为 path
+func writeJSONFile(path string, write func(enc *json.Encoder) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = write(json.NewEncoder(tmp))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// 读取 JSON 文件，文件不存在或者为空时保持 v 不变
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *fileStorage) saveRaftState(term uint64, votedFor string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return writeJSONFile(s.snapshot+".raft", func(enc *json.Encoder) error {
+		return enc.Encode(raftHardState{Term: term, VotedFor: votedFor})
+	})
+}
+
+func (s *fileStorage) saveRaftEntries(index uint64, entries []raftEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i, entry := range entries {
+		err := enc.Encode(raftLogLine{Index: index + uint64(i), Entry: entry})
+		if err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(s.snapshot+".raftlog", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// 先替换快照文件，再用快照之后的条目重写日志文件。
+// 两步之间崩溃时日志文件中还有快照之前的条目，读取时跳过
+func (s *fileStorage) saveRaftSnapshot(snap raftSnapshot, entries []raftEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := writeJSONFile(s.snapshot+".raftsnap", func(enc *json.Encoder) error {
+		return enc.Encode(snap)
+	})
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(s.snapshot+".raftlog", func(enc *json.Encoder) error {
+		for i, entry := range entries {
+			err := enc.Encode(raftLogLine{Index: snap.Index + 1 + uint64(i), Entry: entry})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *fileStorage) loadRaft() (uint64, string, raftSnapshot, []raftEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var state raftHardState
+	var snap raftSnapshot
+	err := readJSONFile(s.snapshot+".raft", &state)
+	if err == nil {
+		err = readJSONFile(s.snapshot+".raftsnap", &snap)
+	}
+	if err != nil {
+		return 0, "", raftSnapshot{}, nil, err
+	}
+
+	f, err := os.Open(s.snapshot + ".raftlog")
+	if os.IsNotExist(err) {
+		return state.Term, state.VotedFor, snap, nil, nil
+	}
+	if err != nil {
+		return 0, "", raftSnapshot{}, nil, err
+	}
+	defer f.Close()
+	var entries []raftEntry // 快照之后的条目，entries[i] 的下标为 snap.Index+1+i
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var l raftLogLine
+			if jerr := json.Unmarshal(line, &l); jerr != nil {
+				// 与事件日志相同：最后一行不完整说明写入时崩溃，这个条目没有确认过
+				if err == io.EOF {
+					log.Printf("Discarding incomplete raft log entry: %q", line)
+					break
+				}
+				return 0, "", raftSnapshot{}, nil, jerr
+			}
+			switch {
+			case l.Index < 1 || l.Index > snap.Index+uint64(len(entries))+1:
+				return 0, "", raftSnapshot{}, nil, fmt.Errorf("raft log entry %d out of order", l.Index)
+			case l.Index <= snap.Index:
+				// 快照已经包含这个位置；它截断的是之后的条目
+				entries = entries[:0]
+			default:
+				entries = append(entries[:l.Index-snap.Index-1], l.Entry)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, "", raftSnapshot{}, nil, err
+		}
+	}
+	return state.Term, state.VotedFor, snap, entries, nil
+}
+
+func (s *memoryStorage) saveRaftState(term uint64, votedFor string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.raft = raftHardState{Term: term, VotedFor: votedFor}
+	return nil
+}
+
+func (s *memoryStorage) saveRaftEntries(index uint64, entries []raftEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if index <= s.raftSnap.Index || index > s.raftSnap.Index+uint64(len(s.raftLog))+1 {
+		return fmt.Errorf("raft log entry %d out of order", index)
+	}
+	s.raftLog = append(s.raftLog[:index-s.raftSnap.Index-1], entries...)
+	return nil
+}
+
+func (s *memoryStorage) saveRaftSnapshot(snap raftSnapshot, entries []raftEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snap.Registrations = append([]Registration(nil), snap.Registrations...)
+	s.raftSnap = snap
+	s.raftLog = append([]raftEntry(nil), entries...)
+	return nil
+}
+
+func (s *memoryStorage) loadRaft() (uint64, string, raftSnapshot, []raftEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snap := s.raftSnap
+	snap.Registrations = append([]Registration(nil), snap.Registrations...)
+	return s.raft.Term, s.raft.VotedFor, snap, append([]raftEntry(nil), s.raftLog...), nil
+}
@@ -0,0 +1,151 @@
+package registry
+
+// 长轮询：不需要服务暴露 ServiceUpdateURL，由客户端主动向注册中心查询变化。
+// GET /services/watch?epoch=E&since=N&name=LogService 在纪元 E 的版本 N 之后有变化时立即返回，否则一直等到有变化或者超时；
+// 客户端用返回的 Epoch 和 Revision 作为下一次请求的 epoch 和 since。
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 长轮询的等待时间
+const (
+	DefaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+)
+
+// 处理长轮询请求：epoch 和 since 缺省为 0（先返回完整的实例列表），timeout 为最长等待时间，如 timeout=10s
+func (s *RegistryService) watch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// 集群模式下只有主节点发出通知、产生新的版本
+	if s.reg.raft != nil {
+		leader, isLeader := s.reg.raft.leader()
+		if !isLeader {
+			if leader == "" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+	}
+
+	query := r.URL.Query()
+	epoch, since, err := parseCursor(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	timeout := DefaultWatchTimeout
+	if v := query.Get("timeout"); v != "" {
+		var err error
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		timeout = min(timeout, maxWatchTimeout)
+	}
+	var names []ServiceName
+	for _, name := range query["name"] {
+		names = append(names, ServiceName(name))
+	}
+
+	p := s.reg.waitForChanges(r.Context(), epoch, since, names, timeout)
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(p)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// 等待纪元 epoch 中的版本 since 之后 names 中的服务发生变化，超时或者 ctx 取消时返回空的补丁（带有当前的纪元和版本）
+func (r *registry) waitForChanges(ctx context.Context, epoch, since uint64, names []ServiceName, timeout time.Duration) Patch {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		r.mutex.RLock()
+		changed := r.changed
+		r.mutex.RUnlock()
+
+		p := r.changesSince(epoch, since, names)
+		if p.Full || len(p.Added) > 0 || len(p.Removed) > 0 {
+			return p
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return p
+		case <-ctx.Done():
+			return p
+		}
+	}
+}
+
+// 长轮询关注 names 中服务的变化，直到 ctx 被取消，之后移除只从这里得到的实例。收到的变化更新到本地的实例缓存并通知订阅者，
+// 之后 GetProvider、Client 等都可以正常使用。适用于没有 ServiceUpdateURL 的服务或者命令行工具。
+func Watch(ctx context.Context, registryURL string, names ...ServiceName) {
+	var epoch, since uint64
+	view := prov.newView("")
+	defer func() { prov.publish(prov.dropView(view)) }()
+	for ctx.Err() == nil {
+		p, err := watchChanges(ctx, registryURL, epoch, since, names)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to watch %v: %v", names, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		epoch, since = p.Epoch, p.Revision
+		if !p.Full && len(p.Added) == 0 && len(p.Removed) == 0 {
+			continue
+		}
+		prov.publish(prov.apply(view, p))
+	}
+}
+
+// 发送一次长轮询请求
+func watchChanges(ctx context.Context, registryURL string, epoch, since uint64, names []ServiceName) (Patch, error) {
+	res, err := doRegistryRequest(watchClient, registryURL, func(addr string) (*http.Request, error) {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		u.Path = u.Path + "/watch"
+		q := u.Query()
+		q.Set("epoch", strconv.FormatUint(epoch, 10))
+		q.Set("since", strconv.FormatUint(since, 10))
+		q.Set("timeout", DefaultWatchTimeout.String())
+		for _, name := range names {
+			q.Add("name", string(name))
+		}
+		u.RawQuery = q.Encode()
+		return http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	})
+	if err != nil {
+		return Patch{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return Patch{}, fmt.Errorf("failed to watch services. Registry service responded with code %v", res.StatusCode)
+	}
+	var p Patch
+	err = json.NewDecoder(res.Body).Decode(&p)
+	return p, err
+}
@@ -0,0 +1,72 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWatchReceivesChangesWithoutUpdateURL(t *testing.T) {
+	s := NewRegistryServiceWithStorage(NewMemoryStorage())
+	mux := http.NewServeMux()
+	s.RegisterHandlers(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	t.Cleanup(s.Stop)
+	registryURL := srv.URL + "/services"
+
+	const name = ServiceName("Watched")
+	patches := make(chan Patch, 10)
+	unsubscribe := Subscribe(name, func(p Patch) { patches <- p })
+	t.Cleanup(unsubscribe)
+
+	// 观察方没有 ServiceUpdateURL，注册中心不会向它推送，只能通过长轮询得到变化
+	watcher := Registration{ServiceName: "Watcher", ServiceID: "watcher-1", ServiceURL: "http://127.0.0.1:1", RequiredServices: []ServiceName{name}}
+	if err := RegisterService(http.NewServeMux(), registryURL, watcher); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Watch(ctx, registryURL, name)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	next := func() Patch {
+		t.Helper()
+		select {
+		case p := <-patches:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("no change received")
+			return Patch{}
+		}
+	}
+
+	inst := Registration{ServiceName: name, ServiceID: "watched-1", ServiceURL: "http://127.0.0.1:2"}
+	if err := postRegistration(registryURL, inst); err != nil {
+		t.Fatal(err)
+	}
+	if p := next(); len(p.Added) != 1 || p.Added[0].ID != inst.ServiceID {
+		t.Fatalf("expected %s to be added, got %+v", inst.ServiceID, p)
+	}
+	if got, err := GetProviders(name); err != nil || len(got) != 1 {
+		t.Errorf("providers after the watch: %v, %v", got, err)
+	}
+
+	if err := ShutdownService(registryURL, inst.ServiceID); err != nil {
+		t.Fatal(err)
+	}
+	if p := next(); len(p.Removed) != 1 || p.Removed[0].ID != inst.ServiceID {
+		t.Fatalf("expected %s to be removed, got %+v", inst.ServiceID, p)
+	}
+	if got, err := GetProviders(name); err == nil {
+		t.Errorf("providers after removal: %v", got)
+	}
+}
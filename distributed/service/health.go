@@ -0,0 +1,44 @@
+package service
+
+// 健康检查：每个服务注册自己的检查项，心跳接口返回汇总后的健康报告
+
+import (
+	"distributed/registry"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// 健康检查函数：返回检查状态以及说明信息
+type HealthCheck func() (registry.HealthStatus, string)
+
+// 带名称的检查项，例如 "log provider reachable"、"data store loaded"
+type namedCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// 执行所有检查项并汇总
+func runHealthChecks(checks []namedCheck) registry.HealthReport {
+	results := make([]registry.CheckResult, 0, len(checks))
+	for _, c := range checks {
+		status, output := c.check()
+		results = append(results, registry.CheckResult{Name: c.name, Status: status, Output: output})
+	}
+	return registry.NewHealthReport(results)
+}
+
+// 心跳处理程序：返回 JSON 格式的健康报告，critical 时状态码为 503
+func healthHandler(checks []namedCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := runHealthChecks(checks)
+		w.Header().Add("Content-Type", "application/json")
+		if report.Status == registry.HealthCritical {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		err := json.NewEncoder(w).Encode(report)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package service
+
+// 启动选项
+
+import (
+	"context"
+	"distributed/registry"
+	"net"
+	"time"
+)
+
+// 关闭服务的默认时间
+const (
+	DefaultDrainPeriod     = 2 * time.Second  // 取消注册后等待依赖方更新实例列表的时间
+	DefaultShutdownTimeout = 10 * time.Second // 等待正在处理的请求完成的最长时间
+)
+
+type options struct {
+	checks          []namedCheck           // 健康检查项
+	waitCtx         context.Context        // 不为空时等待依赖服务可用，超时由它控制
+	optional        []registry.ServiceName // 不等待、也不影响就绪状态的依赖服务
+	drainPeriod     time.Duration
+	shutdownTimeout time.Duration
+	listener        net.Listener // 不为空时在该监听器上提供服务，而不是监听 host:port
+}
+
+type Option func(*options)
+
+// 注册一个健康检查项，心跳请求时执行
+func WithHealthCheck(name string, check HealthCheck) Option {
+	return func(o *options) {
+		o.checks = append(o.checks, namedCheck{name: name, check: check})
+	}
+}
+
+// 在已经创建好的监听器上提供服务，例如测试中监听 127.0.0.1:0 得到的随机端口；
+// host、port 仍然用于生成实例ID，应当与监听器的地址一致
+func WithListener(l net.Listener) Option {
+	return func(o *options) {
+		o.listener = l
+	}
+}
+
+// 取消注册之后、关闭 HTTP 服务器之前的等待时间，期间仍然处理请求；为 0 时不等待
+func WithDrainPeriod(d time.Duration) Option {
+	return func(o *options) {
+		o.drainPeriod = d
+	}
+}
+
+// 关闭 HTTP 服务器时等待正在处理的请求完成的最长时间
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.shutdownTimeout = d
+	}
+}
+
+// Start 注册后阻塞，直到 RequiredServices 中的每个服务都至少有一个健康实例；
+// ctx 结束（例如 context.WithTimeout 超时）时取消注册、关闭 HTTP 服务器并返回错误。
+// 同时在心跳中报告就绪状态：依赖的服务缺少实例时为 warning，依赖方不会被路由到该服务。
+func WaitForDependencies(ctx context.Context) Option {
+	return func(o *options) {
+		o.waitCtx = ctx
+	}
+}
+
+// 可选的依赖服务：仍然接收它们的实例变化，但 WaitForDependencies 不等待它们，缺少实例时也不影响就绪状态。
+// 例如 LogService：不可用时日志先写到标准错误，不应阻止服务启动
+func WithOptionalDependencies(names ...registry.ServiceName) Option {
+	return func(o *options) {
+		o.optional = append(o.optional, names...)
+	}
+}
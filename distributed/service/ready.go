@@ -0,0 +1,88 @@
+package service
+
+// 就绪状态：依赖的服务都至少有一个健康实例时服务才算就绪。
+// 未就绪时心跳报告 warning，注册中心不会把流量路由到该服务。
+
+import (
+	"context"
+	"distributed/registry"
+	"fmt"
+	"strings"
+)
+
+// 缺少可用实例的依赖服务
+func missingDependencies(required []registry.ServiceName) []registry.ServiceName {
+	var missing []registry.ServiceName
+	for _, name := range required {
+		if _, err := registry.GetProviders(name); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// 需要等待的依赖服务：RequiredServices 中除去可选的服务
+func essentialDependencies(required, optional []registry.ServiceName) []registry.ServiceName {
+	var essential []registry.ServiceName
+	for _, name := range required {
+		isOptional := false
+		for _, o := range optional {
+			if o == name {
+				isOptional = true
+				break
+			}
+		}
+		if !isOptional {
+			essential = append(essential, name)
+		}
+	}
+	return essential
+}
+
+// 就绪检查项
+func readinessCheck(required []registry.ServiceName) HealthCheck {
+	return func() (registry.HealthStatus, string) {
+		missing := missingDependencies(required)
+		if len(missing) > 0 {
+			return registry.HealthWarning, "waiting for " + joinNames(missing)
+		}
+		return registry.HealthPassing, "all required services available"
+	}
+}
+
+// 等待所有依赖服务都有可用的实例，waitCtx 结束（超时）或者服务停止时返回错误
+func waitForDependencies(ctx, waitCtx context.Context, required []registry.ServiceName) error {
+	// 依赖服务的实例变化时重新检查
+	changed := make(chan struct{}, 1)
+	for _, name := range required {
+		unsubscribe := registry.Subscribe(name, func(registry.Patch) {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+		defer unsubscribe()
+	}
+
+	for {
+		missing := missingDependencies(required)
+		if len(missing) == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-waitCtx.Done():
+			return fmt.Errorf("required services not available (%s): %w", joinNames(missing), waitCtx.Err())
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func joinNames(names []registry.ServiceName) string {
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = string(name)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -5,66 +5,162 @@ package service
 import (
 	"context"
 	"distributed/registry"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
-// 启动服务
-func Start(ctx context.Context, host, port string, reg registry.Registration,registerHandlersFunc func())(context.Context,error) {
+// 启动服务，registryURL 为注册中心的访问地址，opts 为可选的启动选项（如健康检查）
+// 每个服务使用自己的 mux：心跳、接收补丁以及 registerHandlersFunc 注册的业务路由都挂载在上面
+// 取消 ctx 或者收到 SIGINT/SIGTERM 时开始关闭，返回的上下文在 HTTP 服务器关闭之后才取消，可以据此等待服务退出。
+// 长时间保持的响应（例如 SSE 推送）应当在 ctx 取消时结束，调用方可以用 signal.NotifyContext 让信号也取消 ctx
+func Start(ctx context.Context, registryURL, host, port string, reg registry.Registration,registerHandlersFunc func(mux *http.ServeMux), opts ...Option)(context.Context,error) {
+	o := options{drainPeriod: DefaultDrainPeriod, shutdownTimeout: DefaultShutdownTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	
+	// 没有指定实例ID时按监听地址生成，同一地址重启后沿用同一个ID，注册中心会更新而不是重复追加
+	if reg.ServiceID == "" {
+		reg.ServiceID = fmt.Sprintf("%s-%s:%s", reg.ServiceName, host, port)
+	}
+
+	mux := http.NewServeMux()
+
+	// 等待依赖时，就绪状态作为一个检查项；有心跳检查时先以未就绪（warning）注册，心跳检查通过后才开始路由。
+	// 租约模式的实例不做心跳检查，续约也不会改变 warning，只能直接注册。可选的依赖不计入就绪状态
+	essential := essentialDependencies(reg.RequiredServices, o.optional)
+	if o.waitCtx != nil && len(essential) > 0 {
+		o.checks = append(o.checks, namedCheck{name: "required services available", check: readinessCheck(essential)})
+		if reg.HeartbeatURL != "" && reg.LeaseTTL <= 0 && reg.Status == "" {
+			reg.Status = registry.HealthWarning
+		}
+	}
+
+	// 心跳检查：返回服务自己的健康报告（租约模式下可以不提供心跳地址）
+	if reg.HeartbeatURL != "" {
+		heartbeatURL, err := url.Parse(reg.HeartbeatURL)
+		if err != nil {
+			return ctx, err
+		}
+		mux.Handle(heartbeatURL.Path, healthHandler(o.checks))
+	}
+
+	// 查看该服务访问依赖服务时各实例的熔断状态
+	mux.Handle("/debug/breakers", registry.BreakerHandler())
+
 	// 每个服务的路由
-	registerHandlersFunc()
-	// 启动服务的http服务器
-	ctx = startService(ctx, reg.ServiceName,host,port)
+	registerHandlersFunc(mux)
+	// 启动服务的http服务器；background 用于续约、长轮询等后台任务，开始关闭时最先取消
+	ctx, background, shutdown := startService(ctx, registryURL, reg.ServiceName, reg.ServiceID, host,port, mux, o)
 
 	// 在启动http服务器后，再请求注册服务
-	err := registry.RegisterService(reg)
+	err := registry.RegisterService(mux, registryURL, reg)
 	if err != nil {
+		// 与等待依赖失败相同：关闭 HTTP 服务器、停止后台任务，返回的上下文随之取消
+		shutdown(0)
 		return ctx, err
 	}
+
+	// 没有更新地址时注册中心无法推送，通过长轮询关注依赖服务的变化
+	if reg.ServiceUpdateURL == "" && len(reg.RequiredServices) > 0 {
+		go registry.Watch(background, registryURL, reg.RequiredServices...)
+	}
+
+	// 租约模式：后台定期续约，开始关闭时先停止续约再取消注册，避免取消后又被重新注册
+	if reg.LeaseTTL > 0 {
+		go registry.KeepAlive(background, registryURL, reg)
+	}
+
+	if o.waitCtx != nil {
+		err = waitForDependencies(ctx, o.waitCtx, essential)
+		if err != nil {
+			// 启动失败：取消注册、关闭 HTTP 服务器，返回的上下文随之取消，不留下还在运行的服务
+			shutdown(0)
+			return ctx, err
+		}
+	}
 	
 	return ctx, nil
 }
 
-// 用于实际启动 HTTP 服务器
-func startService(ctx context.Context, serviceName registry.ServiceName, host, port string) context.Context {
+// 用于实际启动 HTTP 服务器。
+// 返回的 done 在 HTTP 服务器关闭之后才取消（调用方取消 ctx 只是开始关闭）；
+// background 在关闭流程开始时取消；shutdown 立即开始关闭流程
+func startService(ctx context.Context, registryURL string, serviceName registry.ServiceName, serviceID, host, port string, mux *http.ServeMux, o options) (done, background context.Context, shutdown func(drain time.Duration)) {
 
-	// 可以创建一个可取消的上下文，通过传递取消信号来控制取消操作
-	ctx,cancle := context.WithCancel(ctx)
+	// 不继承 ctx：ctx 被取消时服务器还在处理请求，调用方要等到关闭完成
+	done, cancel := context.WithCancel(context.Background())
+	background, stopBackground := context.WithCancel(context.Background())
 	
 	var server http.Server
 	server.Addr = host + ":" + port
+	server.Handler = mux
+
+	// 关闭流程只执行一次：
+	// 1. 停止续约和长轮询；2. 从注册中心取消注册；3. 等待 drain，让依赖方收到 Removed 补丁、不再发来新请求；
+	// 4. 在超时时间内关闭 HTTP 服务器，等待正在处理的请求完成；5. 取消返回的上下文
+	var once sync.Once
+	shutdown = func(drain time.Duration) {
+		once.Do(func() {
+			stopBackground()
+			err := registry.ShutdownService(registryURL, serviceID)
+			if err != nil {
+				log.Println(err)
+			}
+			if drain > 0 {
+				time.Sleep(drain)
+			}
+			// 不能使用 ctx：它可能已经被取消，Shutdown 会立即返回而不等待请求完成
+			shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), o.shutdownTimeout)
+			defer cancelShutdown()
+			err = server.Shutdown(shutdownCtx)
+			if err != nil {
+				log.Println(err)
+			}
+			cancel()
+		})
+	}
 	
 	// 启动 HTTP 服务器
 	go func() {
-		log.Println(server.ListenAndServe())
-
-		// 关闭总服务
-		err := registry.ShutdownService(fmt.Sprintf("http://%s:%s", host, port))
-		if err != nil {
-			log.Println(err)
+		var err error
+		if o.listener != nil {
+			err = server.Serve(o.listener)
+		} else {
+			err = server.ListenAndServe()
 		}
-		// 服务器停止时调用 cancel() 取消上下文。
-		// TODO
-		// 取消上下文在 HTTP 服务器中的作用主要是协调资源释放和实现优雅关闭，
-		// 确保服务器在停止时能够正确处理正在进行的操作，避免资源泄漏和数据不一致的问题。
-		cancle()
+		if errors.Is(err, http.ErrServerClosed) {
+			return
+		}
+		// 服务器异常退出（例如端口被占用）：没有请求需要等待，立即取消注册
+		log.Println(err)
+		shutdown(0)
 	}()
 
-	// 手动强制关闭
+	// 收到 SIGINT/SIGTERM，或者调用方取消了 ctx 时优雅关闭
 	go func(){
-		fmt.Printf("%v started. Press any key to stop. \n", serviceName)
-		var s string
-		fmt.Scanln(&s)	
-		// 关闭总服务
-		err := registry.ShutdownService(fmt.Sprintf("http://%s:%s", host, port))
-		if err != nil {
-			log.Println(err)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(signals)
+		fmt.Printf("%v started. Press Ctrl+C to stop. \n", serviceName)
+		select {
+		case sig := <-signals:
+			log.Printf("Received %v, shutting down %v", sig, serviceName)
+		case <-ctx.Done():
+		case <-done.Done():
+			// 已经因为服务器异常退出而关闭
+			return
 		}
-		server.Shutdown(ctx)
-		cancle()
+		shutdown(o.drainPeriod)
 	}()
 
-	return ctx
-}
\ No newline at end of file
+	return done, background, shutdown
+}
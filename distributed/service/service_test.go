@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"distributed/registry"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStartShutsDownGracefully(t *testing.T) {
+	rs := registry.NewRegistryServiceWithStorage(registry.NewMemoryStorage())
+	regMux := http.NewServeMux()
+	rs.RegisterHandlers(regMux)
+	regSrv := httptest.NewServer(regMux)
+	t.Cleanup(regSrv.Close)
+	t.Cleanup(rs.Stop)
+	registryURL := regSrv.URL + "/services"
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	const name = registry.ServiceName("SlowService")
+	reg := registry.Registration{ServiceName: name, ServiceURL: "http://" + l.Addr().String()}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done, err := Start(ctx, registryURL, host, port, reg, func(mux *http.ServeMux) {
+		mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			io.WriteString(w, "done")
+		})
+	}, WithListener(l), WithDrainPeriod(50*time.Millisecond), WithShutdownTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		res, err := http.Get(reg.ServiceURL + "/slow")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		results <- result{body: string(body), err: err}
+	}()
+	<-started
+	cancel()
+
+	// 请求还在处理时实例已经从注册中心移除，返回的上下文还没有取消
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		regs, err := registry.LookupServices(registryURL, name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(regs) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("instance was not deregistered while a request was in flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 等过 drain，关闭流程停在等待请求完成
+	time.Sleep(100 * time.Millisecond)
+	if done.Err() != nil {
+		t.Fatal("returned context was cancelled before the in-flight request completed")
+	}
+
+	close(release)
+	select {
+	case <-done.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("returned context was not cancelled after shutdown")
+	}
+	select {
+	case res := <-results:
+		if res.err != nil || res.body != "done" {
+			t.Errorf("in-flight request returned %q, %v", res.body, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight request did not complete")
+	}
+	if _, err := http.Get(reg.ServiceURL + "/slow"); err == nil {
+		t.Error("server still accepts requests after shutdown")
+	}
+}
+
+func TestStartShutsDownWhenRegistrationFails(t *testing.T) {
+	// 监听后立即关闭，得到一个无法连接的注册中心地址
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registryURL := "http://" + dead.Addr().String() + "/services"
+	dead.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	reg := registry.Registration{ServiceName: "Unregistered", ServiceURL: "http://" + l.Addr().String()}
+	done, err := Start(context.Background(), registryURL, host, port, reg, func(*http.ServeMux) {}, WithListener(l))
+	if err == nil {
+		t.Fatal("Start succeeded without a registry")
+	}
+	select {
+	case <-done.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("returned context was not cancelled after registration failed")
+	}
+	if _, err := http.Get(reg.ServiceURL + "/heartbeat"); err == nil {
+		t.Error("server still accepts requests after registration failed")
+	}
+}